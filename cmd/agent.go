@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/josebalius/gh-mosh/internal/config"
+	"github.com/josebalius/gh-mosh/internal/mosh"
+)
+
+// runAgent runs the server side agent, normally started by the first
+// server half run with --agent.
+func runAgent(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("gh mosh agent", flag.ContinueOnError)
+	debug := flags.Bool("debug", false, "log debug details")
+	logFile := flags.String("log-file", "", "append logs to this file (default agent.log in the state directory)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var opts mosh.Options
+	if *debug {
+		opts.LogLevel = mosh.LevelDebug
+	}
+	path := *logFile
+	if path == "" {
+		dir, err := config.StateDir()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create state directory: %w", err)
+		}
+		path = filepath.Join(dir, "agent.log")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer f.Close()
+	opts.LogOutput = f
+	return mosh.RunAgent(ctx, opts)
+}
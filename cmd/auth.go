@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/josebalius/gh-mosh/internal/auth"
+	"github.com/josebalius/gh-mosh/internal/mosh"
+	"golang.org/x/term"
+)
+
+func runAuth(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: gh mosh auth <login|logout|status>")
+	}
+	store, err := auth.NewStore()
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "login":
+		return authLogin(store, args[1:])
+	case "logout":
+		return authLogout(store)
+	case "status":
+		return authStatus(store)
+	default:
+		return fmt.Errorf("unknown auth command %q", args[0])
+	}
+}
+
+func authLogin(store *auth.Store, args []string) error {
+	flags := flag.NewFlagSet("gh mosh auth login", flag.ContinueOnError)
+	withToken := flags.Bool("with-token", false, "read the API key from standard input")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var key string
+	if !*withToken && term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Paste your relay API key: ")
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return fmt.Errorf("failed to read API key: %w", err)
+		}
+		key = string(b)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read API key: %w", err)
+		}
+		key = line
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return errors.New("no API key given")
+	}
+
+	source, err := store.Set(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stored API key %s in the %s\n", mosh.Fingerprint(key), describeSource(store, source))
+	warnPlaintext(store, source)
+	return nil
+}
+
+// authLogout removes the stored API key and the relay's GitHub
+// authorization.
+func authLogout(store *auth.Store) error {
+	oauth, err := auth.NewOAuthStore()
+	if err != nil {
+		return err
+	}
+	var removed bool
+	for _, s := range []struct {
+		store *auth.Store
+		what  string
+	}{{store, "API key"}, {oauth, "GitHub authorization for the relay"}} {
+		err := s.store.Delete()
+		if errors.Is(err, auth.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		removed = true
+		fmt.Printf("Removed stored %s\n", s.what)
+	}
+	if !removed {
+		return auth.ErrNotFound
+	}
+	return nil
+}
+
+func authStatus(store *auth.Store) error {
+	if os.Getenv("API_KEY") != "" {
+		fmt.Printf("Using API key %s from the API_KEY environment variable\n", mosh.Fingerprint(os.Getenv("API_KEY")))
+	}
+	key, source, err := store.Get()
+	switch {
+	case errors.Is(err, auth.ErrNotFound):
+		fmt.Println("No API key stored, your GitHub identity is used unless API_KEY or a profile sets one")
+	case err != nil:
+		return err
+	default:
+		fmt.Printf("API key %s is stored in the %s\n", mosh.Fingerprint(key), describeSource(store, source))
+		warnPlaintext(store, source)
+	}
+
+	oauth, err := auth.NewOAuthStore()
+	if err != nil {
+		return err
+	}
+	_, source, err = oauth.Get()
+	switch {
+	case errors.Is(err, auth.ErrNotFound):
+		fmt.Println("The relay is not authorized to know your GitHub identity, it will be on first use")
+	case err != nil:
+		return err
+	default:
+		fmt.Printf("GitHub authorization for the relay is stored in the %s\n", describeSource(oauth, source))
+		warnPlaintext(oauth, source)
+	}
+	return nil
+}
+
+func describeSource(store *auth.Store, source string) string {
+	if source == auth.SourceFile {
+		return "file " + store.Path()
+	}
+	return "OS keyring"
+}
+
+// warnPlaintext warns when no keyring was available and the secret was
+// left in the store's plaintext file.
+func warnPlaintext(store *auth.Store, source string) {
+	if source == auth.SourceFile {
+		fmt.Fprintf(os.Stderr, "WARNING: no OS keyring is available, the secret is stored unencrypted in %s\n", store.Path())
+	}
+}
+
+// ghCredential returns a relay credential for the user's GitHub identity
+// from the relay at authURL, see package auth. The relay's OAuth app is
+// authorized once, its token kept in the credential store. The credential
+// expires, see mosh.Options.CredentialExpiry.
+func ghCredential(ctx context.Context, authURL string) (*auth.RelayCredential, error) {
+	store, err := auth.NewOAuthStore()
+	if err != nil {
+		return nil, err
+	}
+	relay := &auth.RelayAuth{BaseURL: authURL}
+	token, _, err := store.Get()
+	stored := err == nil
+	if errors.Is(err, auth.ErrNotFound) {
+		token, err = authorizeRelay(ctx, relay, store)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cred, err := relay.Exchange(ctx, token)
+	if errors.Is(err, auth.ErrUnauthorized) && stored {
+		// Revoked or expired since it was stored, authorize again.
+		if token, err = authorizeRelay(ctx, relay, store); err != nil {
+			return nil, err
+		}
+		cred, err = relay.Exchange(ctx, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+// authorizeRelay runs GitHub's device flow for the relay's OAuth app and
+// stores the token it yields.
+func authorizeRelay(ctx context.Context, relay *auth.RelayAuth, store *auth.Store) (string, error) {
+	clientID, err := relay.ClientID(ctx)
+	if err != nil {
+		return "", err
+	}
+	code, err := auth.RequestDeviceCode(ctx, clientID)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(os.Stderr, "The relay needs to know who you are, no access to your account is requested.\n")
+	fmt.Fprintf(os.Stderr, "Enter the code %s at %s\n", code.UserCode, code.VerificationURI)
+	token, err := auth.PollDeviceToken(ctx, clientID, code)
+	if err != nil {
+		return "", err
+	}
+	source, err := store.Set(token)
+	if err != nil {
+		return "", err
+	}
+	warnPlaintext(store, source)
+	return token, nil
+}
+
+// relayAuthURL returns the default credential endpoint of the first relay
+// in remoteAddr.
+func relayAuthURL(remoteAddr string) string {
+	relay, _, _ := strings.Cut(remoteAddr, ",")
+	host, ok := strings.CutPrefix(relay, "srv:")
+	if !ok {
+		if h, _, err := net.SplitHostPort(relay); err == nil {
+			host = h
+		}
+	}
+	return "https://" + net.JoinHostPort(host, "443")
+}
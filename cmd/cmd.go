@@ -1,31 +1,374 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/josebalius/gh-mosh/internal/auth"
+	"github.com/josebalius/gh-mosh/internal/config"
 	"github.com/josebalius/gh-mosh/internal/mosh"
+	"github.com/josebalius/gh-mosh/internal/session"
 )
 
 func Execute() error {
-	ctx, cancel := context.WithCancel(context.Background())
+	// SIGTERM, as sent by gh mosh kill, stops every process gh-mosh started.
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM)
 	defer cancel()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "auth":
+			return runAuth(ctx, os.Args[2:])
+		case "sessions":
+			return runSessions(ctx, os.Args[2:])
+		case "kill":
+			return runKill(ctx, os.Args[2:])
+		case "agent":
+			return runAgent(ctx, os.Args[2:])
+		}
+	}
+
+	args := os.Args[1:]
+	resume := len(args) > 0 && args[0] == "resume"
+	if resume {
+		args = args[1:]
+	}
+
+	var opts mosh.Options
+	flags := flag.NewFlagSet("gh mosh", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gh mosh [flags] [<codespace> | --ssh <destination>] [-- <command>...]")
+		fmt.Fprintln(flags.Output(), "       gh mosh resume [flags] [<session>]")
+		fmt.Fprintln(flags.Output(), "       gh mosh sessions [--prune] [--codespace <codespace> | --ssh <destination>]")
+		fmt.Fprintln(flags.Output(), "       gh mosh kill [--codespace <codespace> | --ssh <destination>] <session>")
+		fmt.Fprintln(flags.Output(), "       gh mosh agent [--debug] [--log-file <path>]")
+		fmt.Fprintln(flags.Output(), "")
+		fmt.Fprintln(flags.Output(), "Without a codespace, --repo, --ssh or --local, gh mosh asks which of your codespaces to")
+		fmt.Fprintln(flags.Output(), "connect to, and fails when not run in a terminal. Running the server half from the")
+		fmt.Fprintln(flags.Output(), "working tree, which used to happen without a codespace, now takes --local.")
+		fmt.Fprintln(flags.Output(), "resume reconnects a session whose gh-mosh exited while its mosh-client still runs.")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&opts.Client.Predict, "predict", "", "local echo prediction: adaptive, always, never or experimental")
+	flags.BoolVar(&opts.Client.PredictOverwrite, "predict-overwrite", false, "prediction overwrites instead of inserting")
+	flags.BoolVar(&opts.Client.NoInit, "no-init", false, "do not send terminal initialization string")
+	flags.BoolVar(&opts.Client.TitleNoPrefix, "title-noprefix", false, "do not prefix the window title with [mosh]")
+	flags.StringVar(&opts.Client.EscapeKey, "escape-key", "", "escape character used to control the mosh client")
+	flags.StringVar(&opts.ListenAddr, "listen-addr", "", "host:port for mosh-client to connect to (default loopback, random port)")
+	allowFrom := flags.String("allow-from", "", "comma-separated non-loopback IPs or CIDRs allowed to use the listener")
+	flags.BoolVar(&opts.ShowSecrets, "show-secrets", false, "print API and mosh keys in full (for debugging only)")
+	flags.BoolVar(&opts.Verbose, "verbose", false, "keep logging info records after mosh-client takes over the terminal, see --debug for more detail")
+	debug := flags.Bool("debug", false, "log debug details, implies --verbose")
+	logFile := flags.String("log-file", "", "append logs to this file instead of stderr")
+	flags.StringVar(&opts.Codespace, "codespace", "", "name of the codespace to connect to")
+	flags.StringVar(&opts.SSH, "ssh", "", "run the server half on this host over ssh instead of a codespace: user@host or ssh://user@host:port, the host needs the gh-mosh binary on its PATH")
+	local := flags.Bool("local", false, "run the server half from the current working tree, for development, formerly the default without a codespace")
+	flags.StringVar(&opts.Repo, "repo", "", "connect to your most recently used codespace of this owner/name repository")
+	flags.StringVar(&opts.Branch, "branch", "", "with --repo, only consider codespaces on this branch")
+	flags.BoolVar(&opts.Create, "create", false, "with --repo, create a codespace when there is none")
+	flags.StringVar(&opts.Machine, "machine", "", "machine type of the codespace --create creates")
+	flags.BoolVar(&opts.Agent, "agent", false, "run the session in a long-lived agent shared by every session to the codespace")
+	flags.StringVar(&opts.SessionID, "session", "", "session ID, set by the client for the server half")
+	flags.StringVar(&opts.Install, "install", "", "install policy when mosh is missing or incompatible: auto or never")
+	flags.BoolVar(&opts.Direct, "direct", false, "send traffic straight to the server over UDP while it is reachable, else through the relay")
+	flags.BoolVar(&opts.PeerToPeer, "p2p", false, "hole punch a peer-to-peer path through NATs, keeping the relay as fallback")
+	flags.BoolVar(&opts.Multipath, "multipath", false, "send every datagram through two relays, or the relay and the --p2p path")
+	flags.StringVar(&opts.Transport, "transport", "", "relay transport: auto, udp, tcp, tls or quic (default auto)")
+	flags.StringVar(&opts.RelayStreamAddr, "relay-stream", "", "relay host:port for the tcp and tls transports")
+	flags.StringVar(&opts.RelayQUICAddr, "relay-quic", "", "relay host:port for the quic transport")
+	flags.StringVar(&opts.RelayPublicKey, "relay-key", "", "relay's base64 ed25519 public key, trusted on first use when unset")
+	flags.BoolVar(&opts.InsecureRelay, "insecure-relay", false, "do not verify the relay's identity")
+	credentialExpiry := flags.String("credential-expiry", "", "RFC 3339 time the API key expires at, set by the client for the server half")
+	relayKeys := flags.String("relay-keys", "", "comma-separated relay=key pairs, set by the client for the server half")
+	relay := flags.String("relay", "", "comma-separated relay addresses or srv:<domain>, overrides REMOTE_ADDR")
+	configPath := flags.String("config", "", "path to the config file (default ~/.config/gh-mosh/config.yml)")
+	profileName := flags.String("profile", "", "config profile to use, overrides GH_MOSH_PROFILE")
+	apiKeyStdin := flags.Bool("api-key-stdin", false, "read the API key from the first line of standard input")
+	attach := flags.Int("attach", 0, "attach to the mosh-server on this port, its key read from the second line of standard input")
+	flagArgs, command := splitCommand(args)
+	if err := flags.Parse(flagArgs); err != nil {
+		return err
+	}
+	var sessionID string
+	switch {
+	case flags.NArg() > 1:
+		return fmt.Errorf("unexpected argument %q, use -- to pass a remote command", flags.Arg(1))
+	case resume && len(command) > 0:
+		return errors.New("a resumed session keeps the command it was started with")
+	case resume:
+		sessionID = flags.Arg(0)
+	case flags.NArg() == 1 && opts.Codespace != "":
+		return errors.New("codespace given both as an argument and with --codespace")
+	case flags.NArg() == 1:
+		opts.Codespace = flags.Arg(0)
+	}
+	if opts.Repo == "" && (opts.Branch != "" || opts.Create || opts.Machine != "") {
+		return errors.New("--branch, --create and --machine require --repo")
+	}
+	targets := 0
+	for _, given := range []bool{opts.Codespace != "", opts.Repo != "", opts.SSH != "", *local, resume} {
+		if given {
+			targets++
+		}
+	}
+	if targets > 1 {
+		return errors.New("only one of a codespace, --repo, --ssh, --local or resume may be given")
+	}
+	opts.Command = command
+	if *debug {
+		opts.LogLevel, opts.Verbose = mosh.LevelDebug, true
+	}
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		defer f.Close()
+		opts.LogOutput = f
+	}
+	for _, entry := range strings.Split(*allowFrom, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			opts.AllowFrom = append(opts.AllowFrom, entry)
+		}
+	}
+	if *relayKeys != "" {
+		opts.RelayKeys = make(map[string]string)
+		for _, pair := range strings.Split(*relayKeys, ",") {
+			// Keys are base64 and may end in "=", relay addresses never
+			// contain one.
+			relay, key, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("invalid relay key %q, must be relay=key", pair)
+			}
+			opts.RelayKeys[relay] = key
+		}
+	}
+
+	if *credentialExpiry != "" {
+		expiry, err := time.Parse(time.RFC3339, *credentialExpiry)
+		if err != nil {
+			return fmt.Errorf("invalid credential expiry: %w", err)
+		}
+		opts.CredentialExpiry = expiry
+	}
+
 	appType := mosh.AppTypeClient
 	if os.Getenv("SERVER") == "true" {
 		appType = mosh.AppTypeServer
 	}
 
-	apiKey := os.Getenv("API_KEY")
-	if apiKey == "" {
-		return errors.New("API_KEY is not set")
+	// The server half is configured entirely by the client, so only the
+	// client reads the config file.
+	var profile config.Profile
+	if appType == mosh.AppTypeClient {
+		var err error
+		profile, err = loadProfile(*configPath, *profileName)
+		if err != nil {
+			return err
+		}
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if flags.NArg() == 1 && !resume {
+		set["codespace"] = true
+	}
+	applyProfile(&opts, profile, set)
+
+	if err := opts.Client.Validate(); err != nil {
+		return err
+	}
+	switch opts.Install {
+	case "", mosh.InstallAuto, mosh.InstallNever:
+	default:
+		return fmt.Errorf("invalid install policy %q, must be auto or never", opts.Install)
+	}
+	switch opts.Transport {
+	case "", mosh.TransportAuto, mosh.TransportUDP, mosh.TransportTCP, mosh.TransportTLS, mosh.TransportQUIC:
+	default:
+		return fmt.Errorf("invalid transport %q, must be auto, udp, tcp, tls or quic", opts.Transport)
+	}
+	if *local || opts.Repo != "" || opts.SSH != "" {
+		opts.Codespace = "" // overrides the profile's
+	}
+	// Without a target the user picks one of their codespaces. A MOSH_KEY
+	// means the server half was started by hand and needs none.
+	noTarget := opts.Codespace == "" && opts.Repo == "" && opts.SSH == "" && !*local
+	if appType == mosh.AppTypeClient && !resume && noTarget && os.Getenv("MOSH_KEY") == "" {
+		var err error
+		if opts.Codespace, err = pickCodespace(ctx); err != nil {
+			return err
+		}
 	}
 
-	remoteAddr := os.Getenv("REMOTE_ADDR")
+	var stdin *bufio.Reader
+	if *apiKeyStdin {
+		stdin = bufio.NewReader(os.Stdin)
+	}
+	mosh.HideEnv(profile.APIKeyEnv)
+	apiKey, err := resolveAPIKey(ctx, profile, stdin)
+	if err != nil {
+		return err
+	}
+	if apiKey == "" && appType == mosh.AppTypeServer {
+		return errors.New("API_KEY is not set")
+	}
+	remoteAddr := firstNonEmpty(*relay, os.Getenv("REMOTE_ADDR"), profile.Relay, strings.Join(profile.Relays, ","))
+	switch {
+	case resume:
+		store, err := session.NewStore()
+		if err != nil {
+			return err
+		}
+		sess, err := store.Find(sessionID)
+		if errors.Is(err, session.ErrNotFound) && sessionID == "" {
+			return errors.New("no session to resume")
+		}
+		if err != nil {
+			return err
+		}
+		opts.Resume, opts.Codespace, opts.SSH, opts.Command = sess, sess.Codespace, sess.SSH, sess.Command
+		remoteAddr = strings.Join(sess.Relays, ",")
+	case *attach != 0:
+		if stdin == nil {
+			return errors.New("--attach requires --api-key-stdin")
+		}
+		moshKey, err := readLine(stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read mosh key from stdin: %w", err)
+		}
+		opts.Resume = &session.Session{ServerPort: *attach, MoshKey: moshKey}
+	}
 	if remoteAddr == "" {
 		return errors.New("REMOTE_ADDR is not set")
 	}
+	if apiKey == "" {
+		authURL := firstNonEmpty(os.Getenv("GH_MOSH_RELAY_AUTH_URL"), profile.RelayAuthURL, relayAuthURL(remoteAddr))
+		cred, err := ghCredential(ctx, authURL)
+		if err != nil {
+			return err
+		}
+		apiKey, opts.CredentialExpiry = cred.Credential, cred.ExpiresAt
+	}
 
-	return mosh.NewApp(apiKey, remoteAddr, appType).Run(ctx)
+	return mosh.NewApp(apiKey, remoteAddr, appType, opts).Run(ctx)
+}
+
+// resolveAPIKey returns the relay API key from, in order, stdin when not nil,
+// the API_KEY environment variable, the profile and the credential store. It
+// returns an empty key if none of them has one.
+func resolveAPIKey(ctx context.Context, profile config.Profile, stdin *bufio.Reader) (string, error) {
+	if stdin != nil {
+		key, err := readLine(stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read API key from stdin: %w", err)
+		}
+		return key, nil
+	}
+	if key := os.Getenv("API_KEY"); key != "" {
+		return key, nil
+	}
+	key, err := profile.APIKey(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get API key from profile: %w", err)
+	}
+	if key != "" {
+		return key, nil
+	}
+	store, err := auth.NewStore()
+	if err != nil {
+		return "", err
+	}
+	key, _, err = store.Get()
+	if err != nil && !errors.Is(err, auth.ErrNotFound) {
+		return "", err
+	}
+	return key, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// loadProfile loads the config file and selects a profile, see package
+// config for the precedence rules.
+func loadProfile(path, name string) (config.Profile, error) {
+	if path == "" {
+		path = os.Getenv("GH_MOSH_CONFIG")
+	}
+	if path == "" {
+		var err error
+		if path, err = config.DefaultPath(); err != nil {
+			return config.Profile{}, err
+		}
+	}
+	c, err := config.Load(path)
+	if err != nil {
+		return config.Profile{}, err
+	}
+	return c.Profile(firstNonEmpty(name, os.Getenv("GH_MOSH_PROFILE")))
+}
+
+// applyProfile fills the options that were neither set by a flag nor by the
+// environment variable mosh-client reads for them.
+func applyProfile(opts *mosh.Options, p config.Profile, set map[string]bool) {
+	fromProfile := func(flag, env string) bool {
+		return !set[flag] && (env == "" || os.Getenv(env) == "")
+	}
+	if fromProfile("codespace", "") {
+		opts.Codespace = p.Codespace
+	}
+	if fromProfile("relay-key", "") {
+		opts.RelayPublicKey = p.RelayPublicKey
+	}
+	opts.LegacyRelays = p.LegacyRelays
+	if fromProfile("install", "") {
+		opts.Install = p.Install
+	}
+	if fromProfile("predict", "MOSH_PREDICTION_DISPLAY") {
+		opts.Client.Predict = p.Client.Predict
+	}
+	if fromProfile("predict-overwrite", "MOSH_PREDICTION_OVERWRITE") {
+		opts.Client.PredictOverwrite = p.Client.PredictOverwrite
+	}
+	if fromProfile("no-init", "MOSH_NO_TERM_INIT") {
+		opts.Client.NoInit = p.Client.NoInit
+	}
+	if fromProfile("title-noprefix", "MOSH_TITLE_NOPREFIX") {
+		opts.Client.TitleNoPrefix = p.Client.TitleNoPrefix
+	}
+	if fromProfile("escape-key", "MOSH_ESCAPE_KEY") {
+		opts.Client.EscapeKey = p.Client.EscapeKey
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// splitCommand separates gh-mosh's own arguments from the remote command
+// following the first "--".
+func splitCommand(args []string) (flagArgs, command []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
 }
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/josebalius/gh-mosh/internal/config"
+	"github.com/josebalius/gh-mosh/internal/mosh"
+)
+
+func TestApplyProfile(t *testing.T) {
+	profile := config.Profile{
+		Codespace:      "profile-cs",
+		RelayPublicKey: "profile-key",
+		Client:         config.Client{Predict: "always", NoInit: true},
+	}
+	for _, tt := range []struct {
+		name      string
+		flags     mosh.Options
+		set       map[string]bool
+		env       map[string]string
+		codespace string
+		predict   string
+		noInit    bool
+	}{
+		{
+			name:      "profile",
+			codespace: "profile-cs", predict: "always", noInit: true,
+		},
+		{
+			name:      "env beats profile",
+			env:       map[string]string{"MOSH_PREDICTION_DISPLAY": "never", "MOSH_NO_TERM_INIT": "1"},
+			codespace: "profile-cs", predict: "", noInit: false,
+		},
+		{
+			name:      "flag beats profile",
+			flags:     mosh.Options{Codespace: "flag-cs", Client: mosh.ClientOptions{Predict: "adaptive"}},
+			set:       map[string]bool{"codespace": true, "predict": true},
+			codespace: "flag-cs", predict: "adaptive", noInit: true,
+		},
+		{
+			name:      "flag beats env",
+			flags:     mosh.Options{Client: mosh.ClientOptions{Predict: "adaptive"}},
+			set:       map[string]bool{"predict": true},
+			env:       map[string]string{"MOSH_PREDICTION_DISPLAY": "never"},
+			codespace: "profile-cs", predict: "adaptive", noInit: true,
+		},
+		{
+			name:      "flag set to its zero value",
+			set:       map[string]bool{"no-init": true},
+			codespace: "profile-cs", predict: "always", noInit: false,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, env := range []string{"MOSH_PREDICTION_DISPLAY", "MOSH_NO_TERM_INIT"} {
+				t.Setenv(env, tt.env[env])
+			}
+			opts := tt.flags
+			applyProfile(&opts, profile, tt.set)
+			if opts.Codespace != tt.codespace || opts.Client.Predict != tt.predict || opts.Client.NoInit != tt.noInit {
+				t.Fatalf("codespace, predict, no-init = %q, %q, %v, want %q, %q, %v",
+					opts.Codespace, opts.Client.Predict, opts.Client.NoInit, tt.codespace, tt.predict, tt.noInit)
+			}
+			if opts.RelayPublicKey != "profile-key" {
+				t.Fatalf("relay key = %q", opts.RelayPublicKey)
+			}
+		})
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	content := "default_profile: work\nprofiles:\n  work: {codespace: work-cs}\n  home: {codespace: home-cs}\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name       string
+		path, flag string
+		env        map[string]string
+		want       string
+		err        bool
+	}{
+		{name: "default", path: path, want: "work-cs"},
+		{name: "flag", path: path, flag: "home", want: "home-cs"},
+		{name: "env", path: path, env: map[string]string{"GH_MOSH_PROFILE": "home"}, want: "home-cs"},
+		{name: "flag beats env", path: path, flag: "work", env: map[string]string{"GH_MOSH_PROFILE": "home"}, want: "work-cs"},
+		{name: "config from env", env: map[string]string{"GH_MOSH_CONFIG": path, "GH_MOSH_PROFILE": "home"}, want: "home-cs"},
+		{name: "unknown", path: path, flag: "office", err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+			for _, env := range []string{"GH_MOSH_CONFIG", "GH_MOSH_PROFILE"} {
+				t.Setenv(env, tt.env[env])
+			}
+			p, err := loadProfile(tt.path, tt.flag)
+			if (err != nil) != tt.err || p.Codespace != tt.want {
+				t.Fatalf("loadProfile = %q, %v, want %q, error %v", p.Codespace, err, tt.want, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/josebalius/gh-mosh/internal/auth"
+	"github.com/josebalius/gh-mosh/internal/codespace"
+	"golang.org/x/term"
+)
+
+// pickCodespace asks the user to choose one of their codespaces, typing to
+// narrow the list down. Those of the repository the working directory is a
+// clone of are listed first, the one last picked for it at the top and
+// chosen by pressing enter. It fails without a terminal to ask on.
+func pickCodespace(ctx context.Context) (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return "", errors.New("no codespace given and no terminal to pick one, pass a codespace, --repo, --ssh or --local")
+	}
+	token, err := auth.GHToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	all, err := codespace.NewClient(auth.APIURL(), token).List(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(all) == 0 {
+		return "", errors.New("you have no codespaces, create one with --repo and --create")
+	}
+
+	repo := currentRepo(ctx)
+	choices, err := codespace.NewChoices()
+	if err != nil {
+		return "", err
+	}
+	var last string
+	if repo != "" {
+		if last, err = choices.Last(repo); err != nil {
+			return "", err
+		}
+	}
+	all = orderCodespaces(all, repo, last)
+	if len(all) == 1 {
+		return all[0].Name, nil
+	}
+	picked, err := selectCodespace(all)
+	if err != nil {
+		return "", err
+	}
+	if repo != "" {
+		if err := choices.Remember(repo, picked); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remember codespace: %v\n", err)
+		}
+	}
+	return picked, nil
+}
+
+// pickerPageSize is how many codespaces the picker shows at once.
+const pickerPageSize = 10
+
+// picker is a list to select from with the arrow keys, narrowed down by
+// typing, as gh codespace ssh offers.
+type picker struct {
+	rows    []string // one formatted line per codespace, aligned
+	names   []string
+	query   string
+	matches []int // indexes of the rows matching query
+	cursor  int   // index in matches
+}
+
+func newPicker(all []codespace.Codespace) *picker {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	p := &picker{}
+	for _, cs := range all {
+		name := cs.Name
+		if cs.DisplayName != "" {
+			name = cs.DisplayName + " (" + cs.Name + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			name, orDash(cs.Repository.FullName), orDash(cs.GitStatus.Ref), cs.State, formatTime(cs.LastUsedAt))
+		p.names = append(p.names, cs.Name)
+	}
+	w.Flush()
+	p.rows = strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	p.filter()
+	return p
+}
+
+// filter keeps the rows containing every word of the query, ignoring case.
+func (p *picker) filter() {
+	words := strings.Fields(strings.ToLower(p.query))
+	p.matches, p.cursor = p.matches[:0], 0
+	for i, row := range p.rows {
+		row = strings.ToLower(row)
+		if !slices.ContainsFunc(words, func(w string) bool { return !strings.Contains(row, w) }) {
+			p.matches = append(p.matches, i)
+		}
+	}
+}
+
+// key handles one key press and returns the picked codespace once enter is
+// pressed on one.
+func (p *picker) key(k string) (picked string, err error) {
+	switch k {
+	case "\x03", "\x1b": // ctrl-c, escape
+		return "", errors.New("no codespace picked")
+	case "\r", "\n":
+		if len(p.matches) > 0 {
+			return p.names[p.matches[p.cursor]], nil
+		}
+	case "\x1b[A", "\x1bOA", "\x10": // up, ctrl-p
+		if p.cursor > 0 {
+			p.cursor--
+		}
+	case "\x1b[B", "\x1bOB", "\x0e": // down, ctrl-n
+		if p.cursor < len(p.matches)-1 {
+			p.cursor++
+		}
+	case "\x7f", "\b":
+		if p.query != "" {
+			r := []rune(p.query)
+			p.query = string(r[:len(r)-1])
+			p.filter()
+		}
+	case "\x15": // ctrl-u
+		p.query = ""
+		p.filter()
+	default:
+		if r := []rune(k); len(r) == 1 && r[0] >= ' ' {
+			p.query += k
+			p.filter()
+		}
+	}
+	return "", nil
+}
+
+// render returns the prompt and the page of matches around the cursor.
+func (p *picker) render() []string {
+	lines := []string{"? Choose codespace: " + p.query}
+	if len(p.matches) == 0 {
+		return append(lines, "  no codespace matches")
+	}
+	first := 0
+	if p.cursor >= pickerPageSize {
+		first = p.cursor - pickerPageSize + 1
+	}
+	for i := first; i < len(p.matches) && i < first+pickerPageSize; i++ {
+		prefix := "  "
+		if i == p.cursor {
+			prefix = "> "
+		}
+		lines = append(lines, prefix+p.rows[p.matches[i]])
+	}
+	return lines
+}
+
+// selectCodespace lets the user pick one of all on the terminal, the first
+// one preselected.
+func selectCodespace(all []codespace.Codespace) (string, error) {
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return "", fmt.Errorf("failed to read from terminal: %w", err)
+	}
+	defer term.Restore(int(os.Stdin.Fd()), state)
+
+	p := newPicker(all)
+	// The cursor stays on the prompt line, so every draw starts there.
+	draw := func() {
+		var b strings.Builder
+		b.WriteString("\r\x1b[J")
+		lines := p.render()
+		b.WriteString(strings.Join(lines, "\r\n"))
+		// Leave the cursor after the query.
+		if len(lines) > 1 {
+			fmt.Fprintf(&b, "\x1b[%dA", len(lines)-1)
+		}
+		fmt.Fprintf(&b, "\r\x1b[%dC", len([]rune(lines[0])))
+		os.Stderr.WriteString(b.String())
+	}
+	clear := func() { os.Stderr.WriteString("\r\x1b[J") }
+
+	buf := make([]byte, 64)
+	var pending string // escape sequence cut off by the end of a read
+	for {
+		draw()
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			clear()
+			return "", fmt.Errorf("failed to read from terminal: %w", err)
+		}
+		var keys []string
+		keys, pending = splitKeys(pending + string(buf[:n]))
+		for _, k := range keys {
+			picked, err := p.key(k)
+			if err != nil || picked != "" {
+				clear()
+				return picked, err
+			}
+		}
+	}
+}
+
+// splitKeys splits terminal input into key presses, keeping CSI ("ESC [",
+// parameters, a final byte from 0x40 to 0x7e) and SS3 ("ESC O" and one
+// byte) sequences whole. An escape sequence cut off at the end of in is
+// returned as rest, to be prepended to the next read. Terminals write
+// sequences whole, so an ESC read on its own is the escape key.
+func splitKeys(in string) (keys []string, rest string) {
+	if in == "\x1b" {
+		return []string{in}, ""
+	}
+	for in != "" {
+		if in[0] != 0x1b {
+			_, size := utf8.DecodeRuneInString(in)
+			keys, in = append(keys, in[:size]), in[size:]
+			continue
+		}
+		size := escapeSize(in)
+		if size == 0 {
+			return keys, in
+		}
+		keys, in = append(keys, in[:size]), in[size:]
+	}
+	return keys, ""
+}
+
+// escapeSize returns the length of the key starting with the ESC at the
+// start of in, 0 if in ends before the sequence does.
+func escapeSize(in string) int {
+	if len(in) < 2 {
+		return 0
+	}
+	switch in[1] {
+	case '[':
+		for i := 2; i < len(in); i++ {
+			switch c := in[i]; {
+			case c >= 0x40 && c <= 0x7e:
+				return i + 1
+			case c < 0x20 || c > 0x7e:
+				return i // malformed, ends before the stray byte
+			}
+		}
+		return 0
+	case 'O':
+		if len(in) < 3 {
+			return 0
+		}
+		return 3
+	default:
+		return 1 // the escape key, followed by another key
+	}
+}
+
+// orderCodespaces moves the codespaces of repo to the front, last first,
+// keeping the most recently used order otherwise.
+func orderCodespaces(all []codespace.Codespace, repo, last string) []codespace.Codespace {
+	var first, ofRepo, rest []codespace.Codespace
+	for _, cs := range all {
+		switch {
+		case cs.Name == last && last != "":
+			first = append(first, cs)
+		case repo != "" && strings.EqualFold(cs.Repository.FullName, repo):
+			ofRepo = append(ofRepo, cs)
+		default:
+			rest = append(rest, cs)
+		}
+	}
+	return append(append(first, ofRepo...), rest...)
+}
+
+// currentRepo returns the owner/name of the repository the working
+// directory's origin remote points to, "" outside of a clone.
+func currentRepo(ctx context.Context) string {
+	out, err := exec.CommandContext(ctx, "git", "remote", "get-url", "origin").Output()
+	if err != nil {
+		return ""
+	}
+	// git@github.com:owner/name.git, https://github.com/owner/name and the
+	// like all end in owner/name.
+	url := strings.TrimSuffix(strings.TrimSpace(string(out)), ".git")
+	parts := strings.FieldsFunc(url, func(r rune) bool { return r == '/' || r == ':' })
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2] + "/" + parts[len(parts)-1]
+}
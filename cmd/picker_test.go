@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/josebalius/gh-mosh/internal/codespace"
+)
+
+func testCodespaces() []codespace.Codespace {
+	all := make([]codespace.Codespace, 3)
+	for i, spec := range [][3]string{
+		{"fluffy-disco", "monalisa/dotfiles", "main"},
+		{"shiny-robot", "monalisa/api", "feature"},
+		{"silver-train", "octocat/api", "main"},
+	} {
+		all[i].Name, all[i].Repository.FullName, all[i].GitStatus.Ref = spec[0], spec[1], spec[2]
+		all[i].State = codespace.StateAvailable
+	}
+	return all
+}
+
+func TestPicker(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"first by default", "\r", "fluffy-disco"},
+		{"arrow down", "\x1b[B\x1b[B\r", "silver-train"},
+		{"application arrows", "\x1bOB\x1bOB\x1bOA\r", "shiny-robot"},
+		{"other keys ignored", "\x1b[3~\x1b[1;5B\x1b[H\r", "fluffy-disco"},
+		{"past the end", "\x1b[B\x1b[B\x1b[B\x1b[A\r", "shiny-robot"},
+		{"search", "octo\r", "silver-train"},
+		{"search every word", "api main\r", "silver-train"},
+		{"move among matches", "api\x1b[B\r", "silver-train"},
+		{"backspace", "apix\x7f\r", "shiny-robot"},
+		{"clear search", "octo\x15\r", "fluffy-disco"},
+		{"no match", "nothing\r\x15\r", "fluffy-disco"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPicker(testCodespaces())
+			keys, _ := splitKeys(tt.input)
+			for _, k := range keys {
+				picked, err := p.key(k)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if picked != "" {
+					if picked != tt.want {
+						t.Fatalf("picked %s, want %s", picked, tt.want)
+					}
+					return
+				}
+			}
+			t.Fatalf("nothing picked, want %s", tt.want)
+		})
+	}
+}
+
+func TestPickerCancel(t *testing.T) {
+	p := newPicker(testCodespaces())
+	if _, err := p.key("\x1b"); err == nil {
+		t.Fatal("escape did not cancel")
+	}
+}
+
+func TestSplitKeys(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   string
+		keys []string
+		rest string
+	}{
+		{"runes", "aé", []string{"a", "é"}, ""},
+		{"arrows", "\x1b[A\x1b[B", []string{"\x1b[A", "\x1b[B"}, ""},
+		{"application arrows", "\x1bOA\x1bOB", []string{"\x1bOA", "\x1bOB"}, ""},
+		{"delete", "\x1b[3~x", []string{"\x1b[3~", "x"}, ""},
+		{"modified arrow", "\x1b[1;5A", []string{"\x1b[1;5A"}, ""},
+		{"lone escape", "\x1b", []string{"\x1b"}, ""},
+		{"escape then key", "\x1bx", []string{"\x1b", "x"}, ""},
+		{"malformed", "\x1b[1\rx", []string{"\x1b[1", "\r", "x"}, ""},
+		{"cut after escape", "ab\x1b", []string{"a", "b"}, "\x1b"},
+		{"cut in csi", "a\x1b[1;", []string{"a"}, "\x1b[1;"},
+		{"cut in ss3", "a\x1bO", []string{"a"}, "\x1bO"},
+		{"only a cut csi", "\x1b[", nil, "\x1b["},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, rest := splitKeys(tt.in)
+			if strings.Join(keys, "|") != strings.Join(tt.keys, "|") || len(keys) != len(tt.keys) || rest != tt.rest {
+				t.Fatalf("splitKeys(%q) = %q, %q, want %q, %q", tt.in, keys, rest, tt.keys, tt.rest)
+			}
+		})
+	}
+}
+
+// An arrow cut off by the end of a read, as when the read buffer fills, is
+// completed by the next one and does not cancel.
+func TestPickerSplitArrow(t *testing.T) {
+	p := newPicker(testCodespaces())
+	var pending string
+	for _, read := range []string{"x\x7f\x1b", "[B\x1bO", "B\r"} {
+		var keys []string
+		keys, pending = splitKeys(pending + read)
+		for _, k := range keys {
+			picked, err := p.key(k)
+			if err != nil {
+				t.Fatalf("read %q: %v", read, err)
+			}
+			if picked != "" {
+				if picked != "silver-train" {
+					t.Fatalf("picked %s, want silver-train", picked)
+				}
+				return
+			}
+		}
+	}
+	t.Fatal("nothing picked")
+}
+
+func TestPickerRender(t *testing.T) {
+	p := newPicker(testCodespaces())
+	keys, _ := splitKeys("api\x1b[B")
+	for _, k := range keys {
+		p.key(k)
+	}
+	lines := p.render()
+	if len(lines) != 3 || lines[0] != "? Choose codespace: api" {
+		t.Fatalf("rendered %q", lines)
+	}
+	if !strings.HasPrefix(lines[2], "> silver-train") || !strings.HasPrefix(lines[1], "  shiny-robot") {
+		t.Fatalf("rendered %q", lines)
+	}
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/josebalius/gh-mosh/internal/mosh"
+	"github.com/josebalius/gh-mosh/internal/session"
+)
+
+// runSessions lists the recorded sessions along with what their remotes
+// report about them. With --remote it prints the server half's records on
+// this host instead, as JSON lines, which is how the client queries them.
+// Listing changes nothing, --prune forgets the sessions that ended.
+func runSessions(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("gh mosh sessions", flag.ContinueOnError)
+	remote := flags.Bool("remote", false, "print this host's server side sessions as JSON lines")
+	codespace := flags.String("codespace", "", "also list sessions running in this codespace")
+	ssh := flags.String("ssh", "", "also list sessions running on this ssh destination")
+	prune := flags.Bool("prune", false, "forget the sessions that ended instead of listing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *remote && *prune {
+		return mosh.PruneServerSessions()
+	}
+	if *remote {
+		sessions, err := mosh.ServerSessions()
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for _, sess := range sessions {
+			if err := enc.Encode(sess); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	store, err := session.NewStore()
+	if err != nil {
+		return err
+	}
+	local, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	// Query every remote once, the zero Remote being this host.
+	var remotes []mosh.Remote
+	queried := make(map[mosh.Remote]bool)
+	query := func(r mosh.Remote) {
+		if !queried[r] {
+			queried[r] = true
+			remotes = append(remotes, r)
+		}
+	}
+	if *codespace != "" || *ssh != "" {
+		query(mosh.Remote{Codespace: *codespace, SSH: *ssh})
+	}
+	for _, sess := range local {
+		query(mosh.SessionRemote(sess))
+	}
+	remoteByID := make(map[string]mosh.ServerSession)
+	reachable := make(map[mosh.Remote]bool)
+	var remoteOnly []mosh.ServerSession
+	localIDs := make(map[string]bool)
+	for _, sess := range local {
+		localIDs[sess.ID] = true
+	}
+	remoteOf := make(map[string]mosh.Remote)
+	for _, r := range remotes {
+		sessions, err := mosh.RemoteSessions(ctx, r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			continue
+		}
+		reachable[r] = true
+		for _, sess := range sessions {
+			remoteByID[sess.ID] = sess
+			if !localIDs[sess.ID] {
+				remoteOnly = append(remoteOnly, sess)
+				remoteOf[sess.ID] = r
+			}
+		}
+	}
+
+	if *prune {
+		return pruneSessions(ctx, store, local, remotes, reachable, remoteByID)
+	}
+	if len(local) == 0 && len(remoteOnly) == 0 {
+		fmt.Fprintln(os.Stderr, "No sessions")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREMOTE\tSTARTED\tRELAY\tCLIENT\tLAST ACTIVITY\tSTATE")
+	for _, sess := range local {
+		relay := "-"
+		if len(sess.Relays) > 0 {
+			relay = sess.Relays[0]
+		}
+		client := "detached"
+		if mosh.Attached(sess) {
+			client = "attached"
+		}
+		activity, state := "-", "unknown"
+		if remote, ok := remoteByID[sess.ID]; ok {
+			activity, state = formatTime(remote.LastActivity), "running"
+			if !remote.Running {
+				state = "ended"
+			}
+		} else if reachable[mosh.SessionRemote(sess)] {
+			state = "ended"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			sess.ID, orDash(mosh.SessionRemote(sess).String()), formatTime(sess.Started), relay, client, activity, state)
+	}
+	for _, sess := range remoteOnly {
+		state := "running"
+		if !sess.Running {
+			state = "ended"
+		}
+		// Started from another machine, nothing attaches to it from here.
+		fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t%s\t%s\n",
+			sess.ID, orDash(remoteOf[sess.ID].String()), formatTime(sess.Started), formatTime(sess.LastActivity), state)
+	}
+	return w.Flush()
+}
+
+// pruneSessions forgets the local records of sessions their reachable
+// remotes report ended, then has the remotes prune their own records.
+func pruneSessions(
+	ctx context.Context, store *session.Store, local []*session.Session, remotes []mosh.Remote,
+	reachable map[mosh.Remote]bool, remoteByID map[string]mosh.ServerSession,
+) error {
+	pruned := 0
+	for _, sess := range local {
+		remote, ok := remoteByID[sess.ID]
+		if !reachable[mosh.SessionRemote(sess)] || (ok && remote.Running) || mosh.Attached(sess) {
+			continue
+		}
+		if err := store.Remove(sess.ID); err != nil {
+			return err
+		}
+		pruned++
+	}
+	for _, r := range remotes {
+		if !reachable[r] {
+			continue
+		}
+		if err := mosh.PruneRemoteSessions(ctx, r); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Forgot %d ended sessions\n", pruned)
+	return nil
+}
+
+// runKill terminates a session. With --remote it only terminates this
+// host's server side of it, which is how the client reaches into the
+// remote.
+func runKill(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("gh mosh kill", flag.ContinueOnError)
+	remote := flags.Bool("remote", false, "only stop this host's server side of the session")
+	codespace := flags.String("codespace", "", "codespace running a session that was started elsewhere")
+	ssh := flags.String("ssh", "", "ssh destination running a session that was started elsewhere")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: gh mosh kill [--codespace <codespace> | --ssh <destination>] <session>")
+	}
+	if *remote {
+		return mosh.KillServerSession(flags.Arg(0))
+	}
+
+	store, err := session.NewStore()
+	if err != nil {
+		return err
+	}
+	sess, err := store.Find(flags.Arg(0))
+	if errors.Is(err, session.ErrNotFound) && (*codespace != "" || *ssh != "") {
+		return mosh.KillRemoteSession(ctx, mosh.Remote{Codespace: *codespace, SSH: *ssh}, flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	if err := mosh.KillSession(ctx, sess); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Killed session %s\n", sess.ID)
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	d := time.Since(t).Round(time.Second)
+	if d < time.Minute {
+		return "just now"
+	}
+	return strings.TrimSuffix(d.Truncate(time.Minute).String(), "0s") + " ago"
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
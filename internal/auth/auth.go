@@ -0,0 +1,108 @@
+// Package auth manages relay credentials: API keys kept in a Store, and
+// short-lived credentials a relay issues for the user's GitHub identity, see
+// RelayAuth.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultAPIURL = "https://api.github.com"
+
+// GHToken returns the token of the user's gh login, as printed by
+// `gh auth token`. It is only ever sent to GitHub.
+func GHToken(ctx context.Context) (string, error) {
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, "gh", "auth", "token")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("failed to get gh auth token: %s", msg)
+		}
+		return "", fmt.Errorf("failed to get gh auth token: %w", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", errors.New("gh is not logged in, run gh auth login")
+	}
+	return token, nil
+}
+
+// APIURL returns the base URL of the GitHub REST API, GH_MOSH_GITHUB_API_URL
+// when set so a local stand-in can be used instead.
+func APIURL() string {
+	if url := os.Getenv("GH_MOSH_GITHUB_API_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return defaultAPIURL
+}
+
+// Validator checks a GitHub token and returns the login it belongs to. The
+// relay's Issuer uses one to validate tokens of its OAuth app.
+type Validator interface {
+	Validate(ctx context.Context, token string) (login string, err error)
+}
+
+// GitHubValidator validates tokens against the GitHub REST API.
+type GitHubValidator struct {
+	// BaseURL of the REST API, defaulting to APIURL.
+	BaseURL string
+	Client  *http.Client
+}
+
+func (v *GitHubValidator) Validate(ctx context.Context, token string) (string, error) {
+	baseURL := v.BaseURL
+	if baseURL == "" {
+		baseURL = APIURL()
+	}
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/user", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to validate token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", errors.New("gh auth token is invalid or expired, run gh auth login")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to validate token with status: %s", resp.Status)
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return "", fmt.Errorf("failed to decode user: %w", err)
+	}
+	return user.Login, nil
+}
+
+// StaticValidator is a local stand-in for GitHub that accepts a fixed set of
+// tokens, mapping each to its login.
+type StaticValidator map[string]string
+
+func (v StaticValidator) Validate(ctx context.Context, token string) (string, error) {
+	login, ok := v[token]
+	if !ok {
+		return "", errors.New("unknown token")
+	}
+	return login, nil
+}
@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A relay that accepts GitHub identities runs its own GitHub OAuth app. The
+// user authorizes that app once through GitHub's device flow, asking for no
+// scopes, so its token can only read their public profile. The token is
+// exchanged with the relay over HTTPS for a short-lived relay credential,
+// the only thing ever sent in CONNECT. The user's gh token never leaves
+// their machine.
+
+const defaultWebURL = "https://github.com"
+
+// credentialPrefix starts every relay credential, telling them apart from
+// relay issued API keys.
+const credentialPrefix = "ghm1."
+
+// ErrUnauthorized is returned when the relay rejects the OAuth app's token,
+// revoked or expired, and the app must be authorized again.
+var ErrUnauthorized = errors.New("relay rejected the GitHub authorization")
+
+// WebURL returns the base URL of GitHub's web flows, GH_MOSH_GITHUB_URL
+// when set so a local stand-in can be used instead.
+func WebURL() string {
+	if url := os.Getenv("GH_MOSH_GITHUB_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return defaultWebURL
+}
+
+// DeviceCode is GitHub's answer to a device flow request. The user enters
+// UserCode at VerificationURI to authorize the app.
+type DeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// RequestDeviceCode starts the device flow for the OAuth app clientID
+// without asking for any scope.
+func RequestDeviceCode(ctx context.Context, clientID string) (*DeviceCode, error) {
+	var code DeviceCode
+	if err := postForm(ctx, "/login/device/code", url.Values{"client_id": {clientID}}, &code); err != nil {
+		return nil, fmt.Errorf("failed to start device authorization: %w", err)
+	}
+	return &code, nil
+}
+
+// PollDeviceToken waits for the user to authorize code and returns the
+// app's token.
+func PollDeviceToken(ctx context.Context, clientID string, code *DeviceCode) (string, error) {
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(code.ExpiresIn)*time.Second)
+	defer cancel()
+	form := url.Values{
+		"client_id":   {clientID},
+		"device_code": {code.DeviceCode},
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return "", errors.New("device authorization expired")
+		case <-time.After(interval):
+		}
+		var resp struct {
+			AccessToken string `json:"access_token"`
+			Error       string `json:"error"`
+		}
+		if err := postForm(ctx, "/login/oauth/access_token", form, &resp); err != nil {
+			return "", fmt.Errorf("failed to poll device authorization: %w", err)
+		}
+		switch resp.Error {
+		case "":
+			return resp.AccessToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied":
+			return "", errors.New("device authorization was denied")
+		default:
+			return "", fmt.Errorf("device authorization failed: %s", resp.Error)
+		}
+	}
+}
+
+func postForm(ctx context.Context, path string, form url.Values, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, WebURL()+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// RelayCredential is a credential the relay issued for a GitHub login.
+type RelayCredential struct {
+	Credential string    `json:"credential"`
+	Login      string    `json:"login"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// RelayAuth is the client of a relay's credential endpoint.
+type RelayAuth struct {
+	// BaseURL of the endpoint, https://<relay host> unless configured.
+	BaseURL string
+	Client  *http.Client
+}
+
+// ClientID returns the client ID of the relay's OAuth app.
+func (r *RelayAuth) ClientID(ctx context.Context) (string, error) {
+	var resp struct {
+		ClientID string `json:"client_id"`
+	}
+	if err := r.do(ctx, http.MethodGet, "/oauth/client", "", &resp); err != nil {
+		return "", fmt.Errorf("failed to get the relay's OAuth app: %w", err)
+	}
+	return resp.ClientID, nil
+}
+
+// Exchange trades a token of the relay's OAuth app for a relay credential.
+func (r *RelayAuth) Exchange(ctx context.Context, token string) (*RelayCredential, error) {
+	var cred RelayCredential
+	if err := r.do(ctx, http.MethodPost, "/credentials", token, &cred); err != nil {
+		return nil, fmt.Errorf("failed to exchange GitHub authorization: %w", err)
+	}
+	return &cred, nil
+}
+
+func (r *RelayAuth) do(ctx context.Context, method, path, token string, out any) error {
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(r.BaseURL, "/")+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// Issuer is the relay's side of the exchange: it validates tokens of its
+// OAuth app with Validator and issues credentials signed with Secret, which
+// the relay checks with Verify when it gets CONNECT.
+type Issuer struct {
+	ClientID  string
+	Validator Validator
+	Secret    []byte
+	TTL       time.Duration
+
+	now func() time.Time // time.Now unless set by tests
+}
+
+func (i *Issuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/oauth/client":
+		writeJSON(w, http.StatusOK, map[string]string{"client_id": i.ClientID})
+	case r.Method == http.MethodPost && r.URL.Path == "/credentials":
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "token ")
+		if !ok {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "missing token"})
+			return
+		}
+		login, err := i.Validator.Validate(r.Context(), token)
+		if err != nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"message": err.Error()})
+			return
+		}
+		expires := i.clock().Add(i.TTL).Truncate(time.Second)
+		writeJSON(w, http.StatusOK, RelayCredential{Credential: i.issue(login, expires), Login: login, ExpiresAt: expires})
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found"})
+	}
+}
+
+func (i *Issuer) clock() time.Time {
+	if i.now != nil {
+		return i.now()
+	}
+	return time.Now()
+}
+
+// issue returns ghm1.<login>.<expiry>.<signature>, the login base64 encoded.
+func (i *Issuer) issue(login string, expires time.Time) string {
+	payload := credentialPrefix + base64.RawURLEncoding.EncodeToString([]byte(login)) +
+		"." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + i.sign(payload)
+}
+
+func (i *Issuer) sign(payload string) string {
+	mac := hmac.New(sha256.New, i.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns the login credential was issued for, failing if it was
+// not issued with Secret or has expired.
+func (i *Issuer) Verify(credential string) (string, error) {
+	dot := strings.LastIndexByte(credential, '.')
+	if !strings.HasPrefix(credential, credentialPrefix) || dot < 0 {
+		return "", errors.New("not a relay credential")
+	}
+	payload, sig := credential[:dot], credential[dot+1:]
+	if !hmac.Equal([]byte(sig), []byte(i.sign(payload))) {
+		return "", errors.New("invalid credential signature")
+	}
+	encodedLogin, expiry, ok := strings.Cut(strings.TrimPrefix(payload, credentialPrefix), ".")
+	if !ok {
+		return "", errors.New("malformed credential")
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", errors.New("malformed credential expiry")
+	}
+	if !i.clock().Before(time.Unix(unix, 0)) {
+		return "", errors.New("credential expired")
+	}
+	login, err := base64.RawURLEncoding.DecodeString(encodedLogin)
+	if err != nil {
+		return "", errors.New("malformed credential login")
+	}
+	return string(login), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestIssuer() *Issuer {
+	return &Issuer{
+		ClientID:  "Iv1.relay",
+		Validator: StaticValidator{"app-token": "monalisa"},
+		Secret:    []byte("relay secret"),
+		TTL:       time.Hour,
+	}
+}
+
+func TestExchangeIssuesVerifiableCredential(t *testing.T) {
+	issuer := newTestIssuer()
+	srv := httptest.NewServer(issuer)
+	defer srv.Close()
+	relay := &RelayAuth{BaseURL: srv.URL}
+	ctx := context.Background()
+
+	clientID, err := relay.ClientID(ctx)
+	if err != nil || clientID != "Iv1.relay" {
+		t.Fatalf("ClientID = %q, %v", clientID, err)
+	}
+	cred, err := relay.Exchange(ctx, "app-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Login != "monalisa" || time.Until(cred.ExpiresAt) > time.Hour {
+		t.Fatalf("unexpected credential %+v", cred)
+	}
+	if strings.Contains(cred.Credential, "app-token") {
+		t.Fatal("credential carries the OAuth token")
+	}
+	login, err := issuer.Verify(cred.Credential)
+	if err != nil || login != "monalisa" {
+		t.Fatalf("Verify = %q, %v", login, err)
+	}
+
+	if _, err := relay.Exchange(ctx, "gh-token"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("exchanging an unknown token: %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestIssuerRejectsBadCredentials(t *testing.T) {
+	issuer := newTestIssuer()
+	valid := issuer.issue("monalisa", time.Now().Add(time.Hour))
+	other := &Issuer{Secret: []byte("another relay")}
+
+	for _, tt := range []struct {
+		name       string
+		credential string
+	}{
+		{"api key", "some-api-key"},
+		{"other relay", other.issue("monalisa", time.Now().Add(time.Hour))},
+		{"tampered login", strings.Replace(valid, "bW9uYWxpc2E", "aHVib3Q", 1)},
+		{"expired", issuer.issue("monalisa", time.Now().Add(-time.Second))},
+		{"truncated", valid[:len(valid)-4]},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if login, err := issuer.Verify(tt.credential); err == nil {
+				t.Fatalf("accepted %q for %s", tt.credential, login)
+			}
+		})
+	}
+}
+
+func TestIssuerCredentialExpires(t *testing.T) {
+	issuer := newTestIssuer()
+	now := time.Now()
+	issuer.now = func() time.Time { return now }
+	cred := issuer.issue("monalisa", now.Add(issuer.TTL))
+
+	if _, err := issuer.Verify(cred); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(issuer.TTL)
+	if _, err := issuer.Verify(cred); err == nil {
+		t.Fatal("accepted an expired credential")
+	}
+}
+
+func TestDeviceFlow(t *testing.T) {
+	var polls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/device/code", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "Iv1.relay" || r.Form.Has("scope") {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, DeviceCode{
+			DeviceCode: "dev", UserCode: "ABCD-1234", VerificationURI: "https://github.com/login/device",
+			ExpiresIn: 30, Interval: 1,
+		})
+	})
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("device_code") != "dev" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if polls.Add(1) == 1 {
+			writeJSON(w, http.StatusOK, map[string]string{"error": "authorization_pending"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"access_token": "app-token"})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	t.Setenv("GH_MOSH_GITHUB_URL", srv.URL)
+
+	ctx := context.Background()
+	code, err := RequestDeviceCode(ctx, "Iv1.relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := PollDeviceToken(ctx, "Iv1.relay", code)
+	if err != nil || token != "app-token" {
+		t.Fatalf("PollDeviceToken = %q, %v", token, err)
+	}
+	if polls.Load() != 2 {
+		t.Fatalf("polled %d times, want 2", polls.Load())
+	}
+}
+
+func TestGitHubValidator(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/user" || r.Header.Get("Authorization") != "token app-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"login": "monalisa"})
+	}))
+	defer srv.Close()
+	v := &GitHubValidator{BaseURL: srv.URL}
+
+	if login, err := v.Validate(context.Background(), "app-token"); err != nil || login != "monalisa" {
+		t.Fatalf("Validate = %q, %v", login, err)
+	}
+	if _, err := v.Validate(context.Background(), "revoked"); err == nil {
+		t.Fatal("accepted a revoked token")
+	}
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/josebalius/gh-mosh/internal/config"
+	"github.com/zalando/go-keyring"
+)
+
+const keyringService = "gh-mosh"
+
+// Places a Store can keep its secret.
+const (
+	SourceKeyring = "keyring"
+	SourceFile    = "file"
+)
+
+// ErrNotFound is returned when nothing is stored.
+var ErrNotFound = errors.New("no credential stored")
+
+// Store keeps a secret in the OS keyring. When no keyring is available, as
+// in most headless containers, it falls back to a file only the user can
+// read. That file is plaintext: anyone who can read it, root or a backup,
+// has the secret, so callers should warn when SourceFile is used.
+type Store struct {
+	user string // keyring entry
+	path string // fallback file
+}
+
+// NewStore returns the store of the relay API key.
+func NewStore() (*Store, error) {
+	return newStore("relay-api-key", "credentials")
+}
+
+// NewOAuthStore returns the store of the token of the relay's OAuth app,
+// see RelayAuth.
+func NewOAuthStore() (*Store, error) {
+	return newStore("relay-oauth-token", "oauth-token")
+}
+
+func newStore(user, file string) (*Store, error) {
+	dir, err := config.Dir()
+	if err != nil {
+		return nil, err
+	}
+	return &Store{user: user, path: filepath.Join(dir, file)}, nil
+}
+
+// Path returns the fallback file location.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Get returns the stored secret and where it was found.
+func (s *Store) Get() (key, source string, err error) {
+	key, err = keyring.Get(keyringService, s.user)
+	if err == nil {
+		return key, SourceKeyring, nil
+	}
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", ErrNotFound
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read credentials: %w", err)
+	}
+	if key = strings.TrimSpace(string(b)); key == "" {
+		return "", "", ErrNotFound
+	}
+	return key, SourceFile, nil
+}
+
+// Set stores the secret and reports where it was stored.
+func (s *Store) Set(key string) (source string, err error) {
+	if err := keyring.Set(keyringService, s.user, key); err == nil {
+		// Don't leave an older key behind in the fallback file.
+		if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("failed to remove credentials file: %w", err)
+		}
+		return SourceKeyring, nil
+	}
+	if err := config.WriteFile(s.path, []byte(key+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write credentials: %w", err)
+	}
+	return SourceFile, nil
+}
+
+// Delete removes the secret from every place it may be stored.
+func (s *Store) Delete() error {
+	var found bool
+	if err := keyring.Delete(keyringService, s.user); err == nil {
+		found = true
+	}
+	err := os.Remove(s.path)
+	switch {
+	case err == nil:
+		found = true
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("failed to remove credentials file: %w", err)
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
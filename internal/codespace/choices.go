@@ -0,0 +1,64 @@
+package codespace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/josebalius/gh-mosh/internal/config"
+)
+
+// Choices remembers the codespace last picked for each repository, so the
+// picker can offer it first next time.
+type Choices struct {
+	path string
+}
+
+func NewChoices() (*Choices, error) {
+	dir, err := config.StateDir()
+	if err != nil {
+		return nil, err
+	}
+	return &Choices{path: filepath.Join(dir, "codespace_choices.json")}, nil
+}
+
+// Last returns the codespace last picked for repo, "" if none was.
+func (c *Choices) Last(repo string) (string, error) {
+	choices, err := c.load()
+	if err != nil {
+		return "", err
+	}
+	return choices[strings.ToLower(repo)], nil
+}
+
+// Remember records name as the codespace picked for repo.
+func (c *Choices) Remember(repo, name string) error {
+	choices, err := c.load()
+	if err != nil {
+		return err
+	}
+	choices[strings.ToLower(repo)] = name
+	b, err := json.MarshalIndent(choices, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode codespace choices: %w", err)
+	}
+	return config.WriteFile(c.path, b, 0600)
+}
+
+func (c *Choices) load() (map[string]string, error) {
+	choices := make(map[string]string)
+	b, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return choices, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read codespace choices: %w", err)
+	}
+	if err := json.Unmarshal(b, &choices); err != nil {
+		return nil, fmt.Errorf("failed to parse codespace choices: %w", err)
+	}
+	return choices, nil
+}
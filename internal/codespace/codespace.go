@@ -0,0 +1,244 @@
+// Package codespace manages the lifecycle of GitHub codespaces through the
+// REST API, so a codespace that is shut down can be started, or a new one
+// created, before the server half is run in it.
+package codespace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Codespace states reported by the API. Only the ones gh-mosh acts on are
+// listed, any other state is waited out.
+const (
+	StateAvailable = "Available"
+	StateShutdown  = "Shutdown"
+	StateFailed    = "Failed"
+	StateDeleted   = "Deleted"
+	StateArchived  = "Archived"
+)
+
+// ErrNotFound is returned when the user has no such codespace.
+var ErrNotFound = errors.New("codespace not found")
+
+// Codespace is the subset of the API's codespace object gh-mosh uses.
+type Codespace struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+	State       string `json:"state"`
+	Repository  struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	GitStatus struct {
+		Ref string `json:"ref"`
+	} `json:"git_status"`
+	Machine struct {
+		Name string `json:"name"`
+	} `json:"machine"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// CreateOptions describe a new codespace. Empty fields leave the choice to
+// GitHub: the default branch and the repository's default machine type.
+type CreateOptions struct {
+	Repo    string // owner/name
+	Branch  string
+	Machine string
+}
+
+// Client calls the codespaces REST API on behalf of a user.
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// NewClient returns a client of the API at baseURL, see auth.APIURL,
+// authenticated with token.
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// List returns the user's codespaces, most recently used first.
+func (c *Client) List(ctx context.Context) ([]Codespace, error) {
+	var all []Codespace
+	for page := 1; ; page++ {
+		var resp struct {
+			TotalCount int         `json:"total_count"`
+			Codespaces []Codespace `json:"codespaces"`
+		}
+		path := fmt.Sprintf("/user/codespaces?per_page=100&page=%d", page)
+		if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+			return nil, fmt.Errorf("failed to list codespaces: %w", err)
+		}
+		all = append(all, resp.Codespaces...)
+		if len(resp.Codespaces) == 0 || len(all) >= resp.TotalCount {
+			break
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].LastUsedAt.After(all[j].LastUsedAt) })
+	return all, nil
+}
+
+// Get returns the named codespace, ErrNotFound if the user has none so
+// named.
+func (c *Client) Get(ctx context.Context, name string) (*Codespace, error) {
+	var cs Codespace
+	err := c.do(ctx, http.MethodGet, "/user/codespaces/"+url.PathEscape(name), nil, &cs)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get codespace %s: %w", name, err)
+	}
+	return &cs, nil
+}
+
+// Find returns the most recently used of the user's codespaces of repo,
+// an owner/name repository, on branch when it is not empty.
+func (c *Client) Find(ctx context.Context, repo, branch string) (*Codespace, error) {
+	codespaces, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, cs := range codespaces {
+		if !strings.EqualFold(cs.Repository.FullName, repo) {
+			continue
+		}
+		if branch != "" && cs.GitStatus.Ref != branch {
+			continue
+		}
+		return &cs, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Start asks for the named codespace to be started. It returns before the
+// codespace is available, see Wait.
+func (c *Client) Start(ctx context.Context, name string) error {
+	err := c.do(ctx, http.MethodPost, "/user/codespaces/"+url.PathEscape(name)+"/start", nil, nil)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.status == http.StatusConflict {
+		return nil // already starting
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start codespace %s: %w", name, err)
+	}
+	return nil
+}
+
+// Create creates a codespace. It returns before the codespace is available,
+// see Wait.
+func (c *Client) Create(ctx context.Context, opts CreateOptions) (*Codespace, error) {
+	owner, repo, ok := strings.Cut(opts.Repo, "/")
+	if !ok || owner == "" || repo == "" {
+		return nil, fmt.Errorf("invalid repository %q, must be owner/name", opts.Repo)
+	}
+	body := struct {
+		Ref     string `json:"ref,omitempty"`
+		Machine string `json:"machine,omitempty"`
+	}{opts.Branch, opts.Machine}
+	var cs Codespace
+	path := "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(repo) + "/codespaces"
+	if err := c.do(ctx, http.MethodPost, path, body, &cs); err != nil {
+		return nil, fmt.Errorf("failed to create codespace: %w", err)
+	}
+	return &cs, nil
+}
+
+// Wait polls the named codespace every interval until it is available,
+// starting it whenever it is shut down. progress is called after every poll
+// with the codespace's state and the time spent waiting so far.
+func (c *Client) Wait(ctx context.Context, name string, interval time.Duration, progress func(state string, waited time.Duration)) error {
+	started := time.Now()
+	for {
+		cs, err := c.Get(ctx, name)
+		if err != nil {
+			return err
+		}
+		progress(cs.State, time.Since(started))
+		switch cs.State {
+		case StateAvailable:
+			return nil
+		case StateShutdown:
+			if err := c.Start(ctx, name); err != nil {
+				return err
+			}
+		case StateFailed, StateDeleted, StateArchived:
+			return fmt.Errorf("codespace %s is %s", name, strings.ToLower(cs.State))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// apiError is a response the API answered with an error status.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	if e.message == "" || e.message == http.StatusText(e.status) {
+		return http.StatusText(e.status)
+	}
+	return fmt.Sprintf("%s: %s", http.StatusText(e.status), e.message)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "token "+c.token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var msg struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&msg)
+		return &apiError{status: resp.StatusCode, message: msg.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
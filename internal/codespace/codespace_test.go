@@ -0,0 +1,280 @@
+package codespace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI is a local stand-in for the codespaces API, serving the endpoints
+// Client uses from memory. Started and created codespaces become available
+// after delay, or fail when they are set to.
+type fakeAPI struct {
+	delay time.Duration
+
+	mu         sync.Mutex
+	codespaces map[string]*fakeCodespace
+	created    int
+	starts     int
+}
+
+type fakeCodespace struct {
+	Codespace
+	readyAt time.Time // when a starting codespace becomes available
+	fails   bool      // fail instead of becoming available
+}
+
+func newFakeAPI(t *testing.T, delay time.Duration, codespaces ...*fakeCodespace) (*fakeAPI, *Client) {
+	f := &fakeAPI{delay: delay, codespaces: make(map[string]*fakeCodespace)}
+	for _, cs := range codespaces {
+		f.codespaces[cs.Name] = cs
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, NewClient(srv.URL, "token")
+}
+
+func fakeOf(name, state, repo, ref string, lastUsed time.Time) *fakeCodespace {
+	cs := &fakeCodespace{}
+	cs.Name, cs.State, cs.LastUsedAt = name, state, lastUsed
+	cs.Repository.FullName, cs.GitStatus.Ref = repo, ref
+	return cs
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "token token" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "Bad credentials"})
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "user" && parts[1] == "codespaces":
+		list := []Codespace{} // the API never answers null
+		for _, cs := range f.codespaces {
+			list = append(list, f.refresh(cs))
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"total_count": len(list), "codespaces": list})
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "user" && parts[1] == "codespaces":
+		cs, ok := f.codespaces[parts[2]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, f.refresh(cs))
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[0] == "user" && parts[3] == "start":
+		cs, ok := f.codespaces[parts[2]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+			return
+		}
+		if f.refresh(cs).State != StateShutdown {
+			writeJSON(w, http.StatusConflict, map[string]string{"message": "Codespace is not shut down"})
+			return
+		}
+		f.starts++
+		cs.State, cs.readyAt = "Starting", time.Now().Add(f.delay)
+		writeJSON(w, http.StatusOK, cs.Codespace)
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[0] == "repos" && parts[3] == "codespaces":
+		if parts[2] == "private" { // as for repositories the token cannot see
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+			return
+		}
+		var body struct {
+			Ref     string `json:"ref"`
+			Machine string `json:"machine"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		f.created++
+		cs := fakeOf(fmt.Sprintf("%s-%d", parts[2], f.created), "Provisioning", parts[1]+"/"+parts[2], body.Ref, time.Now())
+		cs.readyAt = time.Now().Add(f.delay)
+		cs.Machine.Name = body.Machine
+		f.codespaces[cs.Name] = cs
+		writeJSON(w, http.StatusCreated, cs.Codespace)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+	}
+}
+
+func (f *fakeAPI) startCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.starts
+}
+
+// refresh moves a starting codespace on once its delay has passed.
+func (f *fakeAPI) refresh(cs *fakeCodespace) Codespace {
+	if !cs.readyAt.IsZero() && time.Now().After(cs.readyAt) {
+		cs.State, cs.readyAt, cs.LastUsedAt = StateAvailable, time.Time{}, time.Now()
+		if cs.fails {
+			cs.State = StateFailed
+		}
+	}
+	return cs.Codespace
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// wait calls Client.Wait and returns the states it reported.
+func wait(ctx context.Context, c *Client, name string) ([]string, error) {
+	var states []string
+	err := c.Wait(ctx, name, 5*time.Millisecond, func(state string, waited time.Duration) {
+		if len(states) == 0 || states[len(states)-1] != state {
+			states = append(states, state)
+		}
+	})
+	return states, err
+}
+
+func TestWaitStartsShutdownCodespace(t *testing.T) {
+	f, c := newFakeAPI(t, 50*time.Millisecond, fakeOf("cs", StateShutdown, "o/r", "main", time.Now()))
+	states, err := wait(context.Background(), c, "cs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{StateShutdown, "Starting", StateAvailable}; strings.Join(states, ",") != strings.Join(want, ",") {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	if n := f.startCount(); n != 1 {
+		t.Fatalf("started %d times, want 1", n)
+	}
+}
+
+func TestWaitFailedCodespace(t *testing.T) {
+	cs := fakeOf("cs", StateShutdown, "o/r", "main", time.Now())
+	cs.fails = true
+	_, c := newFakeAPI(t, 10*time.Millisecond, cs)
+	if _, err := wait(context.Background(), c, "cs"); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Fatalf("Wait = %v, want the codespace to have failed", err)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	_, c := newFakeAPI(t, time.Hour, fakeOf("cs", StateShutdown, "o/r", "main", time.Now()))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := wait(ctx, c, "cs"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait = %v, want deadline exceeded", err)
+	}
+}
+
+func TestStart(t *testing.T) {
+	f, c := newFakeAPI(t, time.Hour,
+		fakeOf("shutdown", StateShutdown, "o/r", "main", time.Now()),
+		fakeOf("starting", "Starting", "o/r", "main", time.Now()),
+		fakeOf("available", StateAvailable, "o/r", "main", time.Now()),
+	)
+	for _, tt := range []struct {
+		name string
+		err  string
+	}{
+		{"shutdown", ""},
+		{"starting", ""}, // the API answers 409
+		{"available", ""},
+		{"missing", "Not Found"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.Start(context.Background(), tt.name)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Start = %v, want error %q", err, tt.err)
+			}
+		})
+	}
+	if n := f.startCount(); n != 1 {
+		t.Fatalf("started %d codespaces, want 1", n)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	_, c := newFakeAPI(t, 0, fakeOf("cs", StateAvailable, "o/r", "main", time.Now()))
+	if _, err := c.Get(context.Background(), "cs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get = %v, want ErrNotFound", err)
+	}
+
+	// Only a missing codespace is ErrNotFound, other 404s keep the API's
+	// answer.
+	_, createErr := c.Create(context.Background(), CreateOptions{Repo: "o/private"})
+	for name, err := range map[string]error{
+		"Start":  c.Start(context.Background(), "missing"),
+		"Create": createErr,
+	} {
+		var apiErr *apiError
+		if errors.Is(err, ErrNotFound) || !errors.As(err, &apiErr) || apiErr.status != http.StatusNotFound || apiErr.message != "Not Found" {
+			t.Fatalf("%s = %v, want the API's 404", name, err)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	_, c := newFakeAPI(t, 20*time.Millisecond)
+	cs, err := c.Create(context.Background(), CreateOptions{Repo: "owner/repo", Branch: "dev", Machine: "basicLinux32gb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Repository.FullName != "owner/repo" || cs.GitStatus.Ref != "dev" || cs.Machine.Name != "basicLinux32gb" {
+		t.Fatalf("created %+v", cs)
+	}
+	states, err := wait(context.Background(), c, cs.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if states[len(states)-1] != StateAvailable {
+		t.Fatalf("states = %v", states)
+	}
+
+	if _, err := c.Create(context.Background(), CreateOptions{Repo: "repo"}); err == nil {
+		t.Fatal("created a codespace of an invalid repository")
+	}
+}
+
+func TestFind(t *testing.T) {
+	now := time.Now()
+	_, c := newFakeAPI(t, 0,
+		fakeOf("old-main", StateShutdown, "Owner/Repo", "main", now.Add(-2*time.Hour)),
+		fakeOf("new-main", StateShutdown, "owner/repo", "main", now.Add(-time.Hour)),
+		fakeOf("feature", StateShutdown, "owner/repo", "feature", now.Add(-3*time.Hour)),
+		fakeOf("other", StateAvailable, "owner/other", "main", now),
+	)
+	for _, tt := range []struct {
+		repo, branch string
+		want         string
+	}{
+		{"owner/repo", "", "new-main"},
+		{"OWNER/REPO", "main", "new-main"},
+		{"owner/repo", "feature", "feature"},
+		{"owner/repo", "missing", ""},
+		{"owner/missing", "", ""},
+	} {
+		t.Run(tt.repo+"@"+tt.branch, func(t *testing.T) {
+			cs, err := c.Find(context.Background(), tt.repo, tt.branch)
+			if tt.want == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("Find = %v, %v, want not found", cs, err)
+				}
+				return
+			}
+			if err != nil || cs.Name != tt.want {
+				t.Fatalf("Find = %v, %v, want %s", cs, err, tt.want)
+			}
+		})
+	}
+}
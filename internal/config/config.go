@@ -0,0 +1,201 @@
+// Package config loads the gh-mosh configuration file.
+//
+// The file lives at $XDG_CONFIG_HOME/gh-mosh/config.yml (~/.config/gh-mosh/config.yml
+// when XDG_CONFIG_HOME is unset) and holds named profiles:
+//
+//	default_profile: work
+//	profiles:
+//	  work:
+//	    relay: relay.example.com:9000
+//	    api_key_env: WORK_RELAY_KEY
+//	    codespace: monalisa-dotfiles-abc123
+//	    install: never
+//	    client:
+//	      predict: always
+//	      escape_key: "~"
+//
+// Settings are resolved in this order, later sources winning:
+//
+//  1. built-in defaults
+//  2. the selected profile (--profile, then GH_MOSH_PROFILE, then default_profile)
+//  3. environment variables (API_KEY, REMOTE_ADDR, MOSH_PREDICTION_DISPLAY, ...)
+//  4. command line flags
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	DefaultProfile string             `yaml:"default_profile"`
+	Profiles       map[string]Profile `yaml:"profiles"`
+}
+
+type Profile struct {
+	// Relay is the relay server address, host:port.
+	Relay string `yaml:"relay"`
+
+	// Relays lists several relays to choose from by latency and to fail
+	// over between, used when Relay is empty. An entry "srv:<domain>"
+	// expands to the domain's _gh-mosh._udp SRV records.
+	Relays []string `yaml:"relays"`
+
+	// RelayPublicKey pins the relay's base64 ed25519 public key.
+	RelayPublicKey string `yaml:"relay_public_key"`
+
+	// LegacyRelays lists relays predating HELLO, which may be used without
+	// proving their identity, the API key sent to them in the clear.
+	LegacyRelays []string `yaml:"legacy_relays"`
+
+	// RelayAuthURL is the relay's endpoint exchanging GitHub identities for
+	// relay credentials, https://<relay host> when empty.
+	RelayAuthURL string `yaml:"relay_auth_url"`
+
+	// APIKeyEnv names an environment variable holding the relay API key.
+	APIKeyEnv string `yaml:"api_key_env"`
+
+	// APIKeyCommand is run through the shell and its output used as the
+	// relay API key, e.g. "pass show gh-mosh/relay".
+	APIKeyCommand string `yaml:"api_key_command"`
+
+	// Codespace is connected to when none is given on the command line.
+	Codespace string `yaml:"codespace"`
+
+	// Install is the mosh install policy, "auto" or "never".
+	Install string `yaml:"install"`
+
+	Client Client `yaml:"client"`
+}
+
+// Client holds mosh-client settings, see mosh.ClientOptions.
+type Client struct {
+	Predict          string `yaml:"predict"`
+	PredictOverwrite bool   `yaml:"predict_overwrite"`
+	NoInit           bool   `yaml:"no_init"`
+	TitleNoPrefix    bool   `yaml:"title_noprefix"`
+	EscapeKey        string `yaml:"escape_key"`
+}
+
+// Dir returns the directory holding gh-mosh configuration.
+func Dir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "gh-mosh"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	return filepath.Join(home, ".config", "gh-mosh"), nil
+}
+
+// StateDir returns the directory holding state gh-mosh keeps between runs,
+// such as running sessions.
+func StateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "gh-mosh"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	return filepath.Join(home, ".local", "state", "gh-mosh"), nil
+}
+
+// WriteFile writes b to path, creating its directory if needed. It writes
+// a temporary file and renames it into place, so a crash never leaves path
+// truncated and concurrent writers never interleave.
+func WriteFile(path string, b []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name()) // fails once renamed
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// DefaultPath returns the path of the config file used when none is given.
+func DefaultPath() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.yml"), nil
+}
+
+// Load reads the config file at path. A missing file is not an error and
+// yields an empty config.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	var c Config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Profile returns the named profile, or the default profile if name is
+// empty. An empty name without a default profile yields the zero Profile.
+func (c *Config) Profile(name string) (Profile, error) {
+	if name == "" {
+		name = c.DefaultProfile
+	}
+	if name == "" {
+		return Profile{}, nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("profile %q not found", name)
+	}
+	return p, nil
+}
+
+// APIKey resolves the profile's credential reference. It returns an empty
+// key if the profile does not reference one.
+func (p Profile) APIKey(ctx context.Context) (string, error) {
+	if p.APIKeyEnv != "" {
+		key := os.Getenv(p.APIKeyEnv)
+		if key == "" {
+			return "", fmt.Errorf("%s is not set", p.APIKeyEnv)
+		}
+		return key, nil
+	}
+	if p.APIKeyCommand != "" {
+		out, err := exec.CommandContext(ctx, "sh", "-c", p.APIKeyCommand).Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run api_key_command: %w", err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "file.json")
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil || string(b) != content {
+			t.Fatalf("read %q, %v, want %q", b, err, content)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("mode %v, want 0600", info.Mode().Perm())
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("left %d files behind, %v", len(entries), err)
+	}
+}
+
+const testConfig = `default_profile: work
+profiles:
+  work:
+    relay: relay.example.com:9000
+    api_key_env: WORK_RELAY_KEY
+    client:
+      predict: always
+  home:
+    relays: [a.example.com:9000, srv:example.com]
+    api_key_command: echo " home-key "
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		path     string
+		profiles int
+		err      bool
+	}{
+		{"missing file", filepath.Join(t.TempDir(), "missing.yml"), 0, false},
+		{"valid", writeConfig(t, testConfig), 2, false},
+		{"empty", writeConfig(t, ""), 0, false},
+		{"malformed", writeConfig(t, "profiles: [unclosed"), 0, true},
+		{"wrong shape", writeConfig(t, "profiles: a string"), 0, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Load(tt.path)
+			if (err != nil) != tt.err {
+				t.Fatalf("Load error = %v, want error %v", err, tt.err)
+			}
+			if err == nil && len(c.Profiles) != tt.profiles {
+				t.Fatalf("loaded %d profiles, want %d", len(c.Profiles), tt.profiles)
+			}
+		})
+	}
+}
+
+func TestProfile(t *testing.T) {
+	c, err := Load(writeConfig(t, testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noDefault := &Config{Profiles: c.Profiles}
+	for _, tt := range []struct {
+		name    string
+		config  *Config
+		profile string
+		relay   string
+		err     bool
+	}{
+		{"default profile", c, "", "relay.example.com:9000", false},
+		{"named profile", c, "home", "", false},
+		{"unknown profile", c, "office", "", true},
+		{"no default", noDefault, "", "", false},
+		{"unknown without default", noDefault, "office", "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := tt.config.Profile(tt.profile)
+			if (err != nil) != tt.err {
+				t.Fatalf("Profile(%q) error = %v, want error %v", tt.profile, err, tt.err)
+			}
+			if p.Relay != tt.relay {
+				t.Fatalf("relay = %q, want %q", p.Relay, tt.relay)
+			}
+		})
+	}
+	if home, _ := c.Profile("home"); len(home.Relays) != 2 || home.Relays[1] != "srv:example.com" {
+		t.Fatalf("relays = %v", home.Relays)
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	t.Setenv("WORK_RELAY_KEY", "work-key")
+	t.Setenv("EMPTY_RELAY_KEY", "")
+	for _, tt := range []struct {
+		name    string
+		profile Profile
+		want    string
+		err     bool
+	}{
+		{"none", Profile{}, "", false},
+		{"env", Profile{APIKeyEnv: "WORK_RELAY_KEY"}, "work-key", false},
+		{"env unset", Profile{APIKeyEnv: "EMPTY_RELAY_KEY"}, "", true},
+		{"env wins over command", Profile{APIKeyEnv: "WORK_RELAY_KEY", APIKeyCommand: "echo other"}, "work-key", false},
+		{"command", Profile{APIKeyCommand: `echo " home-key "`}, "home-key", false},
+		{"failing command", Profile{APIKeyCommand: "exit 3"}, "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := tt.profile.APIKey(context.Background())
+			if (err != nil) != tt.err || key != tt.want {
+				t.Fatalf("APIKey = %q, %v, want %q, error %v", key, err, tt.want, tt.err)
+			}
+		})
+	}
+}
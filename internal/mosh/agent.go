@@ -0,0 +1,297 @@
+package mosh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/josebalius/gh-mosh/internal/config"
+)
+
+// agentVersion is bumped whenever the agent protocol changes. The server
+// half stops an agent of another version and starts its own.
+const agentVersion = 2
+
+// agentStartTimeout is how long the server half waits for an agent it
+// started to listen, or for a stale agent it stopped to exit.
+const agentStartTimeout = 5 * time.Second
+
+// agentHelloTimeout is how long the server half waits for the agent's
+// hello. Agents predating version 2 send none.
+const agentHelloTimeout = time.Second
+
+// agentHello is the first thing the agent sends on every connection.
+type agentHello struct {
+	Version int `json:"version"`
+	PID     int `json:"pid"`
+}
+
+// agentRequest asks the agent to run a session with the server half's
+// settings. The agent answers with the session's control stream.
+type agentRequest struct {
+	Version    int     `json:"version"`
+	APIKey     string  `json:"api_key"`
+	RemoteAddr string  `json:"remote_addr"`
+	Options    Options `json:"options"`
+}
+
+// agentSocketPath returns where the agent listens. The socket is only
+// accessible to the user, as requests carry the relay API key.
+func agentSocketPath() (string, error) {
+	dir, err := config.StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "agent.sock"), nil
+}
+
+// agentLockPath returns the file the running agent holds locked, so only
+// one agent at a time owns the socket.
+func agentLockPath() (string, error) {
+	dir, err := config.StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "agent.lock"), nil
+}
+
+// RunAgent serves sessions for server halves until ctx is done. Each
+// session gets its own mosh-server and relay pairing, and outlives the
+// server half that asked for it until mosh-server exits, so several clients
+// can share a host without bootstrapping it each time.
+func RunAgent(ctx context.Context, opts Options) error {
+	out := opts.LogOutput
+	if out == nil {
+		out = os.Stderr
+	}
+	log := newLogger(out, opts.LogLevel, false, opts.ShowSecrets).with("agent")
+
+	path, err := agentSocketPath()
+	if err != nil {
+		return err
+	}
+	lockPath, err := agentLockPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	lock, err := lockFile(lockPath, false)
+	if errors.Is(err, errLocked) {
+		return errors.New("agent is already running")
+	}
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	// Holding the lock, any socket left there is stale.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer ln.Close()
+	if err := os.Chmod(path, 0600); err != nil {
+		return fmt.Errorf("failed to restrict socket: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	log.Info("Listening", "socket", path, "pid", os.Getpid())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to accept: %w", err)
+		}
+		go serveAgentConn(ctx, log, out, conn)
+	}
+}
+
+func serveAgentConn(ctx context.Context, log *logger, out io.Writer, conn net.Conn) {
+	defer conn.Close()
+	ctl := newControlWriter(conn)
+
+	if err := json.NewEncoder(conn).Encode(agentHello{Version: agentVersion, PID: os.Getpid()}); err != nil {
+		log.Warn("Failed to greet", "err", err)
+		return
+	}
+	var req agentRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		log.Warn("Invalid request", "err", err)
+		return
+	}
+	if req.Version != agentVersion {
+		ctl.fail(fmt.Errorf("agent speaks version %d, not %d", agentVersion, req.Version))
+		return
+	}
+
+	opts := req.Options
+	opts.LogOutput = out
+	app := NewApp(req.APIKey, req.RemoteAddr, AppTypeServer, opts)
+	app.inAgent = true
+	log.Info("Starting session", "session", opts.SessionID)
+	// The session is bound to the agent, not to the connection, so it
+	// survives the server half going away.
+	if err := app.serve(ctx, ctl); err != nil {
+		log.Warn("Session failed", "session", opts.SessionID, "err", err)
+		return
+	}
+	log.Info("Session ended", "session", opts.SessionID)
+}
+
+// runViaAgent hands the session to the agent, starting one if none is
+// running, and passes its control stream on to the client.
+func (a *App) runViaAgent(ctx context.Context) error {
+	conn, err := a.dialAgent(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	opts := a.opts
+	opts.LogOutput = nil
+	req := agentRequest{Version: agentVersion, APIKey: a.apiKey, RemoteAddr: a.remoteAddr, Options: opts}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("failed to send request to agent: %w", err)
+	}
+	if _, err := io.Copy(os.Stdout, conn); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to read from agent: %w", err)
+	}
+	return nil
+}
+
+// dialAgent connects to the agent, first starting one if none is running
+// or stopping and replacing one of another version.
+func (a *App) dialAgent(ctx context.Context) (net.Conn, error) {
+	path, err := agentSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	if conn, err := d.DialContext(ctx, "unix", path); err == nil {
+		hello, err := readAgentHello(conn)
+		if err == nil && hello.Version == agentVersion {
+			return conn, nil
+		}
+		if hello.PID == 0 {
+			hello.PID = peerPID(conn)
+		}
+		conn.Close()
+		if err := a.stopAgent(ctx, path, hello); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := config.StateDir()
+	if err != nil {
+		return nil, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find gh-mosh: %w", err)
+	}
+	logPath := filepath.Join(dir, "agent.log")
+	a.log.Info("Starting agent", "log", logPath)
+	cmd := exec.Command(exe, "agent", "--log-file="+logPath)
+	if a.opts.LogLevel <= LevelDebug {
+		cmd.Args = append(cmd.Args, "--debug")
+	}
+	cmd.Env = childEnv()
+	// Crashes are written to stderr, not through the logger.
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open agent log: %w", err)
+	}
+	defer logFile.Close()
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start agent: %w", err)
+	}
+	cmd.Process.Release()
+
+	ctx, cancel := context.WithTimeout(ctx, agentStartTimeout)
+	defer cancel()
+	for {
+		conn, err := d.DialContext(ctx, "unix", path)
+		if err == nil {
+			if _, err = readAgentHello(conn); err == nil {
+				return conn, nil
+			}
+			conn.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("agent did not start, see %s: %w", logPath, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func readAgentHello(conn net.Conn) (agentHello, error) {
+	var hello agentHello
+	conn.SetReadDeadline(time.Now().Add(agentHelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	// The agent sends nothing more until it gets a request, so the decoder
+	// cannot read past the hello.
+	if err := json.NewDecoder(conn).Decode(&hello); err != nil {
+		return hello, fmt.Errorf("failed to read agent hello: %w", err)
+	}
+	return hello, nil
+}
+
+// stopAgent stops the stale agent listening on path and waits for it to
+// release the socket. Its sessions lose their relay, mosh-server keeps
+// running so they can be resumed.
+func (a *App) stopAgent(ctx context.Context, path string, hello agentHello) error {
+	if hello.PID == 0 {
+		return errors.New("an agent of another version is running and its pid is unknown, stop it")
+	}
+	a.log.Info("Replacing agent of another version", "version", hello.Version, "pid", hello.PID)
+	if err := terminate(hello.PID); err != nil {
+		return fmt.Errorf("failed to stop agent: %w", err)
+	}
+	lockPath, err := agentLockPath()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, agentStartTimeout)
+	defer cancel()
+	var d net.Dialer
+	for {
+		// Agents predating the lock only go quiet on the socket.
+		conn, err := d.DialContext(ctx, "unix", path)
+		if err != nil {
+			if lock, err := lockFile(lockPath, false); err == nil {
+				lock.Close()
+				return nil
+			}
+		} else {
+			conn.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("agent %d did not stop: %w", hello.PID, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
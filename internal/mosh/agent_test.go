@@ -0,0 +1,55 @@
+package mosh
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRunAgentOwnsSocket(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := Options{LogOutput: io.Discard}
+	done := make(chan error, 1)
+	go func() { done <- RunAgent(ctx, opts) }()
+
+	path, err := agentSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conn net.Conn
+	for deadline := time.Now().Add(agentStartTimeout); ; {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("agent did not listen: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer conn.Close()
+	hello, err := readAgentHello(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.Version != agentVersion || hello.PID != os.Getpid() {
+		t.Fatalf("hello = %+v", hello)
+	}
+
+	// A second agent must neither remove the socket nor listen on it.
+	if err := RunAgent(ctx, opts); err == nil {
+		t.Fatal("second agent started")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("second agent removed the socket: %v", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
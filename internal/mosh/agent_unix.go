@@ -0,0 +1,14 @@
+//go:build unix
+
+package mosh
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detach runs cmd in a session of its own, so it outlives the server half
+// and the ssh session that started it.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
@@ -2,9 +2,16 @@ package mosh
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/josebalius/gh-mosh/internal/session"
 )
 
 type AppType int
@@ -14,68 +21,262 @@ const (
 	AppTypeServer
 )
 
+// Options configure optional App behavior.
+type Options struct {
+	// Client is forwarded to the local mosh-client process.
+	Client ClientOptions
+
+	// Command is run by mosh-server in place of the login shell.
+	Command []string
+
+	// Codespace runs the server half in the named codespace. When it,
+	// Repo and SSH are all empty the server half runs from the current
+	// working tree, for development, which gh mosh only asks for with
+	// --local. Otherwise gh mosh opens a picker to fill in Codespace.
+	Codespace string
+
+	// SSH runs the server half on this ssh destination instead of in a
+	// codespace, user@host or ssh://user@host:port. The host needs the
+	// gh-mosh binary on its PATH, not gh, and no inbound UDP.
+	SSH string
+
+	// Repo picks the most recently used codespace of this owner/name
+	// repository, on Branch when set, when Codespace is empty.
+	Repo   string
+	Branch string
+
+	// Create creates a codespace of Repo on Branch when the user has none,
+	// with the Machine type when set.
+	Create  bool
+	Machine string
+
+	// Direct sends traffic straight to mosh-server while the server host
+	// answers probes over UDP, and through the relay, which stays
+	// connected, whenever it does not.
+	Direct bool
+
+	// PeerToPeer asks the relay for the peer's public endpoint and moves
+	// traffic to a hole punched path when one opens, keeping the relay as
+	// fallback.
+	PeerToPeer bool
+
+	// Multipath sends every datagram through two relays, or through the
+	// relay and the peer-to-peer path, and keeps the first copy received.
+	Multipath bool
+
+	// Transport is how the relay is reached, TransportAuto when empty.
+	Transport string
+
+	// RelayStreamAddr is the relay's TCP address for the TCP and TLS
+	// transports, see App.streamAddr for the defaults.
+	RelayStreamAddr string
+
+	// RelayQUICAddr is the relay's QUIC address for the QUIC transport,
+	// the relay host on port 443 when empty.
+	RelayQUICAddr string
+
+	// RelayPublicKey pins the relay's base64 ed25519 public key. When empty
+	// the key recorded in the known relays file is used, or the relay's key
+	// is trusted and recorded on first use.
+	RelayPublicKey string
+
+	// RelayKeys are the keys, by relay address, the relays must present
+	// to the server half. The client sets them from the keys it verified,
+	// and to "legacy" for relays it accepted as predating HELLO.
+	RelayKeys map[string]string
+
+	// LegacyRelays may be used without answering HELLO, as relays
+	// predating it, when no key is pinned or recorded for them. CONNECT is
+	// then sent to them unsealed. Any other relay must prove its identity.
+	LegacyRelays []string
+
+	// InsecureRelay skips verifying the relay's identity, for relays that
+	// cannot prove it.
+	InsecureRelay bool
+
+	// CredentialExpiry is when the relay stops accepting the API key, zero
+	// when it does not expire. Relay credentials issued for a GitHub login
+	// expire, a session cannot reconnect to a relay after that.
+	CredentialExpiry time.Time
+
+	// Resume reconnects the relay between the mosh-client and mosh-server
+	// of a session whose gh-mosh processes exited, instead of starting a
+	// new session. The server half only uses its ServerPort and MoshKey.
+	Resume *session.Session
+
+	// Agent runs the session in a long-lived agent on the server host,
+	// started on first use, instead of in the server half itself.
+	Agent bool
+
+	// SessionID names the session in both halves' records, see package
+	// session. The client picks it and hands it to the server half.
+	SessionID string
+
+	// Install is the policy for missing or incompatible mosh binaries,
+	// InstallAuto when empty.
+	Install string
+
+	// ListenAddr is the local address mosh-client connects to. It defaults
+	// to the loopback interface so other hosts cannot reach the tunnel.
+	ListenAddr string
+
+	// AllowFrom lists non-loopback IPs or CIDR ranges allowed to send to
+	// ListenAddr. Packets from anywhere else are dropped.
+	AllowFrom []string
+
+	// ShowSecrets prints API and mosh keys in full instead of fingerprints.
+	ShowSecrets bool
+
+	// LogLevel is the minimum level logged.
+	LogLevel LogLevel
+
+	// LogOutput receives log records, defaulting to stderr.
+	LogOutput io.Writer `json:"-"`
+
+	// Verbose keeps logging at LogLevel after mosh-client takes over the
+	// terminal. Otherwise only warnings and errors are written to stderr.
+	Verbose bool
+}
+
 type App struct {
 	appType AppType
+	opts    Options
+	log     *logger
 
 	apiKey     string
-	remoteAddr string
+	remoteAddr string   // comma-separated relays, see resolveRelays
+	relays     []string // in the order they are tried
+
+	inAgent bool // the server half runs as one of the agent's sessions
 }
 
-func NewApp(apiKey, remoteAddr string, appType AppType) *App {
+func NewApp(apiKey, remoteAddr string, appType AppType, opts Options) *App {
+	out, quietable := opts.LogOutput, false
+	if out == nil {
+		out, quietable = os.Stderr, !opts.Verbose
+	}
+	log := newLogger(out, opts.LogLevel, quietable, opts.ShowSecrets)
+	log.addSecret(apiKey)
 	return &App{
 		appType: appType,
+		opts:    opts,
+		log:     log,
 
 		apiKey:     apiKey,
 		remoteAddr: remoteAddr,
 	}
 }
 
-func (a *App) Run(ctx context.Context) error {
+func (a *App) remote() Remote {
+	return Remote{Codespace: a.opts.Codespace, SSH: a.opts.SSH}
+}
+
+func (a *App) Run(ctx context.Context) (err error) {
 	if a.appType == AppTypeServer {
-		return a.runServer(ctx)
+		if a.opts.Agent {
+			return a.runViaAgent(ctx)
+		}
+		return a.serve(ctx, newControlWriter(os.Stdout))
+	}
+	if a.relays, err = resolveRelays(ctx, a.remoteAddr); err != nil {
+		return err
 	}
 	return a.runClient(ctx)
 }
 
-func (a *App) runServer(ctx context.Context) (err error) {
+// serve runs the server half, reporting to the client through ctl.
+func (a *App) serve(ctx context.Context, ctl *controlWriter) (err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		if e := ctl.fail(err); e != nil {
+			a.log.Error("failed to report error", "err", e)
+		}
+	}()
+	if a.relays, err = resolveRelays(ctx, a.remoteAddr); err != nil {
+		return err
+	}
+	return a.runServer(ctx, ctl)
+}
+
+func (a *App) runServer(ctx context.Context, ctl *controlWriter) (err error) {
+	// In the agent the process outlives the session, stop its goroutines.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	moshServerClientCh, relayServerClientCh := make(chan []byte), make(chan []byte)
-	errs := make(chan error, 1)
+	errs := make(chan error, 3)
 
-	serverProcess := newServerProcess()
+	serverProcess := newServerProcess(a.opts.Command)
 	defer safeStop(serverProcess, &err)
 
-	fmt.Println("Ensuring compatibility...")
-	installer := newInstaller(serverProcess)
-	if err := installer.ensureCompatible(ctx); err != nil {
-		return fmt.Errorf("failed to ensure compatibility: %w", err)
-	}
+	var (
+		port      int64
+		moshKey   string
+		serverPID int
+	)
+	if a.opts.Resume != nil {
+		if err := ctl.progress("Attaching to mosh server..."); err != nil {
+			return err
+		}
+		port, moshKey = int64(a.opts.Resume.ServerPort), a.opts.Resume.MoshKey
+		if serverPID, err = a.resumedServer(int(port)); err != nil {
+			return err
+		}
+	} else {
+		if err := ctl.progress("Ensuring compatibility..."); err != nil {
+			return err
+		}
+		installer := newInstaller(a.log.with("installer"), serverProcess, a.opts.Install)
+		if err := installer.ensureCompatible(ctx); err != nil {
+			return fmt.Errorf("failed to ensure compatibility: %w", err)
+		}
 
-	fmt.Println("Starting mosh server process...")
-	if err := serverProcess.run(ctx); err != nil {
-		return fmt.Errorf("failed to run server process: %w", err)
-	}
+		if err := ctl.progress("Starting mosh server process..."); err != nil {
+			return err
+		}
+		if err := serverProcess.run(ctx); err != nil {
+			return fmt.Errorf("failed to run server process: %w", err)
+		}
 
-	fmt.Println("Getting connection details...")
-	port, moshKey, err := serverProcess.connDetails()
-	if err != nil {
-		return fmt.Errorf("failed to get mosh key: %w", err)
+		if err := ctl.progress("Getting connection details..."); err != nil {
+			return err
+		}
+		if port, moshKey, err = serverProcess.connDetails(); err != nil {
+			return fmt.Errorf("failed to get mosh key: %w", err)
+		}
+		// Without it mosh-server cannot be told apart from another process
+		// taking its port once it exits.
+		if serverPID = serverProcess.pid(); serverPID == 0 {
+			return errors.New("mosh-server did not report its pid")
+		}
 	}
-	remoteAddr, err := net.ResolveUDPAddr("udp", a.remoteAddr)
+	a.log.addSecret(moshKey)
+	serverVersion, err := serverProcess.version(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to resolve remote address: %w", err)
+		return fmt.Errorf("failed to get mosh server version: %w", err)
 	}
 
-	fmt.Println("Starting relay server client...")
-	client := newRelayServerClient(a.apiKey, moshKey, remoteAddr, moshServerClientCh, relayServerClientCh)
+	if err := ctl.progress("Connecting to relay server..."); err != nil {
+		return err
+	}
+	client, err := a.openRelays(ctx, moshKey, moshServerClientCh, relayServerClientCh)
+	if err != nil {
+		return fmt.Errorf("failed to connect to relay server: %w", err)
+	}
 	defer safeStop(client, &err)
+	// Cancel before the relay is stopped so it is not taken for a failure.
+	defer cancel()
 	go func() {
-		if err := client.connect(ctx); err != nil {
-			errs <- fmt.Errorf("failed to connect to relay server: %w", err)
+		if err := client.serve(ctx); err != nil {
+			errs <- fmt.Errorf("failed to relay: %w", err)
 		}
 	}()
 
-	fmt.Println("Starting mosh server client...")
-	serverClient := newMoshServerClient(port, relayServerClientCh, moshServerClientCh)
+	if err := ctl.progress("Starting mosh server client..."); err != nil {
+		return err
+	}
+	serverClient := newMoshServerClient(a.log.with("server-client"), port, relayServerClientCh, moshServerClientCh)
 	defer safeStop(serverClient, &err)
 	go func() {
 		if err := serverClient.connect(ctx); err != nil {
@@ -83,12 +284,47 @@ func (a *App) runServer(ctx context.Context) (err error) {
 		}
 	}()
 
-	fmt.Println("Printing mosh key...")
-	if _, err := fmt.Fprintf(os.Stdout, "%s %s\n", moshKeyPrefix, moshKey); err != nil {
-		return fmt.Errorf("failed to print mosh key: %w", err)
+	details := controlMessage{
+		Type:          controlConnect,
+		MoshKey:       moshKey,
+		RelayAddr:     client.current(),
+		ServerVersion: serverVersion.String(),
+		ServerPort:    int(port),
+	}
+	if a.opts.Direct {
+		if err := ctl.progress("Starting direct probe responder..."); err != nil {
+			return err
+		}
+		var addrs []string
+		if addrs, err = advertisedAddrs(); err != nil {
+			return err
+		}
+		responder := newProbeResponder(a.log.with("probe"), moshKey)
+		defer safeStop(responder, &err)
+		if details.ProbePort, err = responder.listen(addrs); err != nil {
+			return fmt.Errorf("failed to start probe responder: %w", err)
+		}
+		details.ServerAddrs = addrs
+		go func() {
+			if err := responder.serve(ctx); err != nil {
+				a.log.Warn("Probe responder stopped", "err", err)
+			}
+		}()
+	}
+	if err := ctl.send(details); err != nil {
+		return fmt.Errorf("failed to send connection details: %w", err)
+	}
+	if a.opts.SessionID != "" {
+		go a.recordServerSession(ctx, int(port), serverPID, serverClient)
 	}
+	go func() {
+		waitExit(ctx, serverPID, int(port))
+		errs <- nil // the session ended
+	}()
 
-	fmt.Println("Running...")
+	// The client has what it needs, a session run by the agent outlives the
+	// connection, so failing to report progress from here on is harmless.
+	ctl.progress("Running...")
 	return await(ctx, errs)
 }
 
@@ -97,82 +333,219 @@ func (a *App) runClient(ctx context.Context) (err error) {
 	errs := make(chan error, 4)
 
 	moshKey := os.Getenv("MOSH_KEY")
-	if moshKey == "" {
-		fmt.Println("Starting codespace process...")
-		codespaceProcess := newCodespaceProcess(a.apiKey, a.remoteAddr)
-		defer safeStop(codespaceProcess, &err)
+	var (
+		sess      = a.opts.Resume
+		relayKeys map[string]string
+		args      []string
+		stdin     = []string{a.apiKey}
+		direct    *controlMessage // what the server half advertised for a direct path
+	)
+	if sess != nil {
+		if err := resumable(sess); err != nil {
+			return err
+		}
+		// Both halves must keep walking the relays in the order the
+		// session started with.
+		moshKey, relayKeys = sess.MoshKey, sess.RelayKeys
+		args = append(a.remoteArgs(relayKeys), "--attach="+strconv.Itoa(sess.ServerPort))
+		stdin = append(stdin, moshKey)
+		a.opts.SessionID = sess.ID
+	} else {
+		a.log.Info("Selecting relay server...")
+		if relayKeys, err = a.selectRelays(ctx); err != nil {
+			return err
+		}
+		if a.opts.SessionID, err = session.NewID(); err != nil {
+			return err
+		}
+		args = a.remoteArgs(relayKeys)
+	}
+	args = append(args, "--session="+a.opts.SessionID)
+	a.log.addSecret(moshKey)
+	if moshKey == "" || sess != nil {
+		if err := a.ensureCodespace(ctx); err != nil {
+			return err
+		}
+		a.log.Info("Starting remote process...", "remote", a.remote())
+		remoteProcess := newRemoteProcess(
+			a.log.with("remote"), a.remote().launcher(), stdin, strings.Join(a.relays, ","), a.opts.Command, args,
+		)
+		defer safeStop(remoteProcess, &err)
 		go func() {
-			if err := codespaceProcess.start(ctx); err != nil {
-				errs <- fmt.Errorf("failed to start codespace process: %w", err)
+			if err := remoteProcess.start(ctx); err != nil {
+				errs <- fmt.Errorf("failed to start remote process: %w", err)
 			}
 		}()
 
-		moshKey, err = codespaceProcess.moshKey(ctx)
+		details, err := remoteProcess.connect(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to get mosh key: %w", err)
 		}
+		moshKey = details.MoshKey
+		a.log.addSecret(moshKey)
+		a.log.Info("Server ready", "mosh_version", details.ServerVersion, "relay", details.RelayAddr)
+		if sess == nil {
+			// Recorded once mosh-client runs, there is nothing to resume
+			// before.
+			sess = a.newSession(details, relayKeys)
+		} else {
+			sess.ClientPID = os.Getpid()
+			a.saveSession(sess)
+		}
+
+		if a.opts.Direct {
+			direct = &details
+		}
+	} else if a.opts.Direct {
+		a.log.Warn("Direct mode needs the server's address, using relay with MOSH_KEY")
 	}
 
-	remoteAddr, err := net.ResolveUDPAddr("udp", a.remoteAddr)
+	a.log.Info("Connecting to relay server...")
+	var relayClient relaySession
+	if direct != nil {
+		relayClient, err = a.openDirect(ctx, moshKey, *direct, moshClientServerCh, relayServerClientCh)
+	} else {
+		relayClient, err = a.openRelays(ctx, moshKey, moshClientServerCh, relayServerClientCh)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to resolve remote address: %w", err)
+		return fmt.Errorf("failed to connect to relay server: %w", err)
 	}
+	defer safeStop(relayClient, &err)
 
-	relayServerClient := newRelayServerClient(a.apiKey, moshKey, remoteAddr, moshClientServerCh, relayServerClientCh)
-	defer safeStop(relayServerClient, &err)
+	var listenAddr *net.UDPAddr
+	if addr := a.opts.ListenAddr; addr != "" || a.opts.Resume != nil {
+		if a.opts.Resume != nil {
+			addr = a.opts.Resume.ListenAddr // where mosh-client keeps sending
+		}
+		listenAddr, err = net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to resolve listen address: %w", err)
+		}
+	}
+	filter, err := parsePeerFilter(a.opts.AllowFrom)
+	if err != nil {
+		return fmt.Errorf("failed to parse allowed peers: %w", err)
+	}
 
-	clientServer := newMoshClientServer(relayServerClientCh, moshClientServerCh)
+	clientServer := newMoshClientServer(a.log.with("client-server"), listenAddr, filter, relayServerClientCh, moshClientServerCh)
 	defer safeStop(clientServer, &err)
 
-	fmt.Println("Starting client server...")
+	a.log.Info("Starting client server...")
 	go func() {
 		if err := clientServer.listen(ctx); err != nil {
 			errs <- fmt.Errorf("failed to listen: %w", err)
 		}
 	}()
 
-	fmt.Println("Connecting to relay server...")
 	go func() {
-		if err := relayServerClient.connect(ctx); err != nil {
-			errs <- fmt.Errorf("failed to connect: %w", err)
+		if err := relayClient.serve(ctx); err != nil {
+			errs <- fmt.Errorf("failed to relay: %w", err)
 		}
 	}()
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				fmt.Println("Waiting for client server to start...")
-				if addr := clientServer.localAddr(); addr != nil {
-					fmt.Printf("Starting mosh client with key: %s...\n", moshKey)
-					if err := a.startMoshClient(ctx, moshKey, addr); err != nil {
-						errs <- fmt.Errorf("failed to start mosh client: %w", err)
-						return
-					}
-					errs <- nil // successful exit
-					return
-				}
+	if a.opts.Resume != nil {
+		go func() {
+			a.log.Info("Relay reconnected, mosh-client should catch up within seconds")
+			waitExit(ctx, sess.MoshClientPID, 0)
+			if ctx.Err() == nil {
+				a.forgetSession(sess)
 			}
+			errs <- nil // mosh-client exited
+		}()
+		return await(ctx, errs)
+	}
+	go func() {
+		addr, err := clientServer.waitAddr(ctx)
+		if err != nil {
+			errs <- fmt.Errorf("failed to wait for client server: %w", err)
+			return
+		}
+		a.log.Debug("Starting mosh client", "key", moshKey)
+		if err := a.startMoshClient(ctx, moshKey, addr, sess); err != nil {
+			errs <- fmt.Errorf("failed to start mosh client: %w", err)
+			return
 		}
+		a.forgetSession(sess)
+		errs <- nil // successful exit
 	}()
 
 	return await(ctx, errs)
 }
 
-func (a *App) startMoshClient(ctx context.Context, moshKey string, addr *net.UDPAddr) (err error) {
-	localProcess := newClientProcess(moshKey, addr)
+// startMoshClient runs mosh-client against addr until it exits, recording
+// sess once it runs when sess is not nil.
+func (a *App) startMoshClient(ctx context.Context, moshKey string, addr *net.UDPAddr, sess *session.Session) (err error) {
+	localProcess := newClientProcess(moshKey, addr, a.opts.Client)
 	defer safeStop(localProcess, &err)
 
-	fmt.Println("Ensuring compatibility...")
-	installer := newInstaller(localProcess)
+	a.log.Info("Ensuring compatibility...")
+	installer := newInstaller(a.log.with("installer"), localProcess, a.opts.Install)
 	if err := installer.ensureCompatible(ctx); err != nil {
 		return fmt.Errorf("failed to ensure compatibility: %w", err)
 	}
 
-	fmt.Println("Starting mosh client process...")
-	return localProcess.start(ctx)
+	a.log.Info("Starting mosh client process...")
+	a.log.handoff()
+	if err := localProcess.start(ctx); err != nil {
+		return err
+	}
+	if sess != nil {
+		sess.ClientPID, sess.MoshClientPID, sess.ListenAddr = os.Getpid(), localProcess.pid(), addr.String()
+		a.saveSession(sess)
+	}
+	return localProcess.wait()
+}
+
+// remoteArgs returns the flags that make the server half log like this one
+// and expect the relays to present relayKeys.
+func (a *App) remoteArgs(relayKeys map[string]string) []string {
+	var args []string
+	if a.opts.LogLevel <= LevelDebug {
+		args = append(args, "--debug")
+	}
+	if a.opts.ShowSecrets {
+		args = append(args, "--show-secrets")
+	}
+	if a.opts.Install != "" {
+		args = append(args, "--install="+a.opts.Install)
+	}
+	if a.opts.Direct {
+		args = append(args, "--direct")
+	}
+	if a.opts.PeerToPeer {
+		args = append(args, "--p2p")
+	}
+	if a.opts.Multipath {
+		args = append(args, "--multipath")
+	}
+	if a.opts.Agent {
+		args = append(args, "--agent")
+	}
+	if a.opts.Transport != "" {
+		args = append(args, "--transport="+a.opts.Transport)
+	}
+	if a.opts.RelayStreamAddr != "" {
+		args = append(args, "--relay-stream="+a.opts.RelayStreamAddr)
+	}
+	if a.opts.RelayQUICAddr != "" {
+		args = append(args, "--relay-quic="+a.opts.RelayQUICAddr)
+	}
+	if !a.opts.CredentialExpiry.IsZero() {
+		args = append(args, "--credential-expiry="+a.opts.CredentialExpiry.Format(time.RFC3339))
+	}
+	if len(relayKeys) > 0 {
+		var pairs []string
+		for _, relay := range a.relays {
+			if key, ok := relayKeys[relay]; ok {
+				pairs = append(pairs, relay+"="+key)
+			}
+		}
+		args = append(args, "--relay-keys="+strings.Join(pairs, ","))
+	}
+	if a.opts.InsecureRelay {
+		args = append(args, "--insecure-relay")
+	}
+	return args
 }
 
 type stopper interface {
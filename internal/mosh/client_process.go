@@ -9,39 +9,105 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/Masterminds/semver"
 )
 
 const moshClientBinary = "mosh-client"
 
+// Prediction modes accepted by mosh-client's MOSH_PREDICTION_DISPLAY.
+const (
+	PredictAdaptive     = "adaptive"
+	PredictAlways       = "always"
+	PredictNever        = "never"
+	PredictExperimental = "experimental"
+)
+
+// ClientOptions are the mosh-client settings that plain mosh exposes as flags.
+// Zero values leave the corresponding setting to mosh-client (or to whatever
+// the user already exported in their environment).
+type ClientOptions struct {
+	Predict          string
+	PredictOverwrite bool
+	NoInit           bool
+	TitleNoPrefix    bool
+	EscapeKey        string
+}
+
+// Validate reports whether the options can be handed to mosh-client.
+func (o ClientOptions) Validate() error {
+	switch o.Predict {
+	case "", PredictAdaptive, PredictAlways, PredictNever, PredictExperimental:
+	default:
+		return fmt.Errorf("invalid predict mode %q, must be one of: adaptive, always, never, experimental", o.Predict)
+	}
+	if len(o.EscapeKey) > 1 {
+		return fmt.Errorf("invalid escape key %q, must be a single character", o.EscapeKey)
+	}
+	return nil
+}
+
+func (o ClientOptions) env() []string {
+	var env []string
+	if o.Predict != "" {
+		env = append(env, "MOSH_PREDICTION_DISPLAY="+o.Predict)
+	}
+	if o.PredictOverwrite {
+		env = append(env, "MOSH_PREDICTION_OVERWRITE=yes")
+	}
+	if o.NoInit {
+		env = append(env, "MOSH_NO_TERM_INIT=1")
+	}
+	if o.TitleNoPrefix {
+		env = append(env, "MOSH_TITLE_NOPREFIX=1")
+	}
+	if o.EscapeKey != "" {
+		env = append(env, "MOSH_ESCAPE_KEY="+o.EscapeKey)
+	}
+	return env
+}
+
 type clientProcess struct {
 	moshKey    string
 	serverAddr *net.UDPAddr
+	opts       ClientOptions
 
 	cmd *exec.Cmd
 }
 
-func newClientProcess(moshKey string, serverAddr *net.UDPAddr) *clientProcess {
-	return &clientProcess{moshKey: moshKey, serverAddr: serverAddr}
+func newClientProcess(moshKey string, serverAddr *net.UDPAddr, opts ClientOptions) *clientProcess {
+	return &clientProcess{moshKey: moshKey, serverAddr: serverAddr, opts: opts}
 }
 
 func (c *clientProcess) start(ctx context.Context) error {
-	ipAddr, port := "127.0.0.1", strconv.Itoa(c.serverAddr.Port)
+	ip, port := c.serverAddr.IP, strconv.Itoa(c.serverAddr.Port)
+	if ip == nil || ip.IsUnspecified() {
+		ip = loopbackFor(ip)
+	}
+	ipAddr := ip.String()
 
 	c.cmd = c.processCmd(ctx)
 	c.cmd.Args = append(c.cmd.Args, ipAddr, port)
-	c.cmd.Env = os.Environ()
+	c.cmd.Env = childEnv()
+	c.cmd.Env = append(c.cmd.Env, c.opts.env()...)
 	c.cmd.Env = append(c.cmd.Env, "MOSH_KEY="+c.moshKey)
 	c.cmd.Stdin = os.Stdin
 	c.cmd.Stdout = os.Stdout
 	c.cmd.Stderr = os.Stderr
-	if err := c.cmd.Start(); err != nil {
-		return err
-	}
+	// Let mosh-client restore the terminal when gh-mosh is told to exit.
+	c.cmd.Cancel = func() error { return c.cmd.Process.Signal(syscall.SIGTERM) }
+	return c.cmd.Start()
+}
+
+func (c *clientProcess) wait() error {
 	return c.cmd.Wait()
 }
 
+func (c *clientProcess) pid() int {
+	return c.cmd.Process.Pid
+}
+
 func (c *clientProcess) processCmd(ctx context.Context) *exec.Cmd {
 	return exec.CommandContext(ctx, moshClientBinary)
 }
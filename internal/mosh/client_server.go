@@ -4,25 +4,58 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 )
 
+// maxPendingPackets bounds how many relay packets are held while waiting for
+// mosh-client to send its first packet. The oldest packets are dropped first,
+// mosh retransmits state so losing them is harmless.
+const maxPendingPackets = 64
+
 type moshClientServer struct {
+	log              *logger
 	sender, receiver chan []byte
+	listenAddr       *net.UDPAddr
+	filter           peerFilter
+
+	ready chan struct{} // closed once conn is bound
+	conn  *net.UDPConn
 
-	conn     *net.UDPConn
-	lastaddr *net.UDPAddr
+	mu       sync.Mutex
+	peer     *net.UDPAddr  // last address mosh-client sent from
+	peerSeen chan struct{} // closed once peer is first set
+	warned   map[string]bool
 }
 
-func newMoshClientServer(sender, receiver chan []byte) *moshClientServer {
-	return &moshClientServer{sender: sender, receiver: receiver}
+// newMoshClientServer creates the local endpoint mosh-client talks to. A nil
+// listenAddr binds to the loopback interface on a random port, see
+// loopbackIP.
+func newMoshClientServer(
+	log *logger, listenAddr *net.UDPAddr, filter peerFilter, sender, receiver chan []byte,
+) *moshClientServer {
+	if listenAddr == nil {
+		listenAddr = &net.UDPAddr{IP: loopbackIP()}
+	}
+	return &moshClientServer{
+		log:        log,
+		sender:     sender,
+		receiver:   receiver,
+		listenAddr: listenAddr,
+		filter:     filter,
+		ready:      make(chan struct{}),
+		peerSeen:   make(chan struct{}),
+		warned:     make(map[string]bool),
+	}
 }
 
 func (m *moshClientServer) listen(ctx context.Context) error {
-	conn, err := net.ListenUDP("udp", nil)
+	conn, err := net.ListenUDP("udp", m.listenAddr)
 	if err != nil {
 		return fmt.Errorf("failed to dial udp: %w", err)
 	}
 	m.conn = conn
+	close(m.ready)
+	m.log.Debug("Listening", "addr", conn.LocalAddr())
 
 	errs := make(chan error, 2)
 	go func() {
@@ -41,14 +74,22 @@ func (m *moshClientServer) listen(ctx context.Context) error {
 }
 
 func (m *moshClientServer) stop() error {
-	return m.conn.Close()
+	select {
+	case <-m.ready:
+		return m.conn.Close()
+	default:
+		return nil
+	}
 }
 
-func (m *moshClientServer) localAddr() *net.UDPAddr {
-	if m.conn == nil {
-		return nil
+// waitAddr blocks until the server is listening and returns its local address.
+func (m *moshClientServer) waitAddr(ctx context.Context) (*net.UDPAddr, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-m.ready:
+		return m.conn.LocalAddr().(*net.UDPAddr), nil
 	}
-	return m.conn.LocalAddr().(*net.UDPAddr)
 }
 
 func (m *moshClientServer) read(ctx context.Context) error {
@@ -62,21 +103,128 @@ func (m *moshClientServer) read(ctx context.Context) error {
 			if err != nil {
 				return fmt.Errorf("failed to read from udp: %w", err)
 			}
-			m.lastaddr = incomingAddr
+			if !m.accept(incomingAddr) {
+				continue
+			}
+			m.setPeer(incomingAddr)
 			m.sender <- p[:n]
 		}
 	}
 }
 
 func (m *moshClientServer) write(ctx context.Context) error {
+	var pending [][]byte
+	peerSeen := m.peerSeen
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-peerSeen:
+			peerSeen = nil // flush once, a nil channel never fires again
+			if err := m.flush(pending); err != nil {
+				return err
+			}
+			pending = nil
 		case p := <-m.receiver:
-			if _, err := m.conn.WriteToUDP(p, m.lastaddr); err != nil {
-				return fmt.Errorf("failed to write to udp: %w", err)
+			if m.currentPeer() == nil {
+				if len(pending) == maxPendingPackets {
+					pending = pending[1:]
+				}
+				pending = append(pending, p)
+				continue
+			}
+			if err := m.flush(append(pending, p)); err != nil {
+				return err
+			}
+			pending = nil
+		}
+	}
+}
+
+func (m *moshClientServer) flush(packets [][]byte) error {
+	peer := m.currentPeer()
+	for _, p := range packets {
+		if _, err := m.conn.WriteToUDP(p, peer); err != nil {
+			return fmt.Errorf("failed to write to udp: %w", err)
+		}
+	}
+	return nil
+}
+
+// accept reports whether a packet from addr may enter the relay tunnel and
+// warns the first time a non-loopback address sends to the socket.
+func (m *moshClientServer) accept(addr *net.UDPAddr) bool {
+	if addr.IP.IsLoopback() {
+		return true
+	}
+	allowed := m.filter.allows(addr.IP)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.warned[addr.IP.String()] {
+		m.warned[addr.IP.String()] = true
+		if allowed {
+			m.log.Warn("Accepting packets from non-loopback address", "addr", addr.IP)
+		} else {
+			m.log.Warn("Dropping packets from non-loopback address", "addr", addr.IP)
+		}
+	}
+	return allowed
+}
+
+// setPeer records the address mosh-client last sent from. mosh-client may
+// roam to a new local port, so later packets always win.
+func (m *moshClientServer) setPeer(addr *net.UDPAddr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.peer == nil {
+		close(m.peerSeen)
+	}
+	if m.peer != nil && m.peer.String() != addr.String() {
+		m.log.Debug("mosh-client roamed", "from", m.peer, "to", addr)
+	}
+	m.peer = addr
+}
+
+func (m *moshClientServer) currentPeer() *net.UDPAddr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.peer
+}
+
+// peerFilter lists the non-loopback networks allowed to talk to the local
+// client server. Loopback peers are always allowed.
+type peerFilter []*net.IPNet
+
+// parsePeerFilter parses IP addresses and CIDR ranges into a peerFilter.
+func parsePeerFilter(entries []string) (peerFilter, error) {
+	var f peerFilter
+	for _, entry := range entries {
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
 			}
+			f = append(f, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", entry, err)
+		}
+		f = append(f, ipnet)
+	}
+	return f, nil
+}
+
+func (f peerFilter) allows(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, ipnet := range f {
+		if ipnet.Contains(ip) {
+			return true
 		}
 	}
+	return false
 }
@@ -0,0 +1,214 @@
+package mosh
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testLogger() *logger {
+	return newLogger(io.Discard, LevelDebug, false, false)
+}
+
+// startClientServer runs a moshClientServer on loopback and returns its
+// address along with the channels it forwards through.
+func startClientServer(t *testing.T, filter peerFilter) (addr *net.UDPAddr, fromClient, toClient chan []byte) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	fromClient, toClient = make(chan []byte, 16), make(chan []byte)
+	m := newMoshClientServer(testLogger(), nil, filter, fromClient, toClient)
+	go m.listen(ctx)
+	t.Cleanup(func() {
+		cancel()
+		m.stop()
+	})
+	addr, err := m.waitAddr(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr, fromClient, toClient
+}
+
+func dialClient(t *testing.T, addr *net.UDPAddr) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readString(t *testing.T, conn *net.UDPConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p := make([]byte, maxPacketSize)
+	n, err := conn.Read(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p[:n])
+}
+
+func receive(t *testing.T, ch chan []byte) string {
+	t.Helper()
+	select {
+	case p := <-ch:
+		return string(p)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a packet")
+		return ""
+	}
+}
+
+func TestMoshClientServerQueuesUntilClientSpeaks(t *testing.T) {
+	addr, fromClient, toClient := startClientServer(t, nil)
+
+	// Sent by the server before mosh-client is known, they must be held.
+	for _, p := range []string{"one", "two"} {
+		toClient <- []byte(p)
+	}
+	client := dialClient(t, addr)
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, fromClient); got != "hello" {
+		t.Fatalf("relayed %q, want hello", got)
+	}
+	for _, want := range []string{"one", "two"} {
+		if got := readString(t, client); got != want {
+			t.Fatalf("client got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestMoshClientServerFollowsRoamingClient(t *testing.T) {
+	addr, fromClient, toClient := startClientServer(t, nil)
+
+	first := dialClient(t, addr)
+	first.Write([]byte("from first"))
+	receive(t, fromClient)
+	toClient <- []byte("to first")
+	if got := readString(t, first); got != "to first" {
+		t.Fatalf("first client got %q", got)
+	}
+
+	second := dialClient(t, addr)
+	second.Write([]byte("from second"))
+	receive(t, fromClient)
+	toClient <- []byte("to second")
+	if got := readString(t, second); got != "to second" {
+		t.Fatalf("roamed client got %q", got)
+	}
+}
+
+// TestMoshClientServerConcurrentTraffic is meant for go test -race: the
+// read and write goroutines share the peer while both directions are busy.
+func TestMoshClientServerConcurrentTraffic(t *testing.T) {
+	addr, fromClient, toClient := startClientServer(t, nil)
+	const packets = 200
+
+	clients := []*net.UDPConn{dialClient(t, addr), dialClient(t, addr)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < packets; i++ {
+			clients[i%2].Write([]byte("up")) // roams on every packet
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	go func() {
+		for i := 0; i < packets; i++ {
+			toClient <- []byte("down")
+		}
+	}()
+	go func() {
+		for range fromClient {
+		}
+	}()
+	for _, c := range clients {
+		go func(c *net.UDPConn) {
+			p := make([]byte, maxPacketSize)
+			for {
+				if _, err := c.Read(p); err != nil {
+					return
+				}
+			}
+		}(c)
+	}
+	<-done
+}
+
+func TestParsePeerFilter(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		entries []string
+		allowed []string
+		denied  []string
+		err     bool
+	}{
+		{name: "empty", denied: []string{"192.0.2.1", "2001:db8::1"}},
+		{
+			name:    "addresses",
+			entries: []string{"192.0.2.1", "2001:db8::1"},
+			allowed: []string{"192.0.2.1", "2001:db8::1", "::ffff:192.0.2.1"},
+			denied:  []string{"192.0.2.2", "2001:db8::2"},
+		},
+		{
+			name:    "networks",
+			entries: []string{"192.0.2.0/24", "2001:db8::/32"},
+			allowed: []string{"192.0.2.200", "2001:db8:1::1"},
+			denied:  []string{"198.51.100.1", "2001:db9::1"},
+		},
+		{name: "loopback always", entries: []string{"192.0.2.0/24"}, allowed: []string{"127.0.0.1", "::1"}},
+		{name: "invalid address", entries: []string{"192.0.2.300"}, err: true},
+		{name: "invalid network", entries: []string{"192.0.2.0/33"}, err: true},
+		{name: "host name", entries: []string{"example.com"}, err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parsePeerFilter(tt.entries)
+			if (err != nil) != tt.err {
+				t.Fatalf("parsePeerFilter(%q) error = %v", tt.entries, err)
+			}
+			for _, ip := range tt.allowed {
+				if !f.allows(net.ParseIP(ip)) {
+					t.Errorf("%s is not allowed", ip)
+				}
+			}
+			for _, ip := range tt.denied {
+				if f.allows(net.ParseIP(ip)) {
+					t.Errorf("%s is allowed", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestMoshClientServerDropsFilteredPeers(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 1}
+	for _, tt := range []struct {
+		name    string
+		filter  []string
+		allowed bool
+	}{
+		{"no filter", nil, false},
+		{"allowed address", []string{"198.51.100.7"}, true},
+		{"other network", []string{"192.0.2.0/24"}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := parsePeerFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := newMoshClientServer(testLogger(), nil, filter, nil, nil)
+			if got := m.accept(peer); got != tt.allowed {
+				t.Fatalf("accept = %v, want %v", got, tt.allowed)
+			}
+			if !m.accept(&net.UDPAddr{IP: loopbackIP(), Port: 1}) {
+				t.Fatal("loopback peer was dropped")
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package mosh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/josebalius/gh-mosh/internal/auth"
+	"github.com/josebalius/gh-mosh/internal/codespace"
+)
+
+const (
+	// codespacePollInterval is how often a codespace that is not yet
+	// available is polled.
+	codespacePollInterval = 2 * time.Second
+
+	// codespaceStartTimeout bounds starting or creating a codespace,
+	// creation builds the dev container and can take minutes.
+	codespaceStartTimeout = 10 * time.Minute
+
+	// codespaceProgressInterval is how often waiting is reported while
+	// the state stays the same.
+	codespaceProgressInterval = 15 * time.Second
+)
+
+// ensureCodespace makes the codespace the server half runs in available,
+// choosing one of opts.Repo when none is named, creating it when asked to,
+// and starting it when it is shut down.
+func (a *App) ensureCodespace(ctx context.Context) error {
+	if a.opts.Codespace == "" && a.opts.Repo == "" {
+		return nil // the server half runs from the working tree
+	}
+	token, err := auth.GHToken(ctx)
+	if err != nil {
+		return err
+	}
+	client := codespace.NewClient(auth.APIURL(), token)
+	log := a.log.with("codespace")
+
+	if a.opts.Codespace == "" {
+		cs, err := a.findCodespace(ctx, client)
+		if err != nil {
+			return err
+		}
+		a.opts.Codespace = cs.Name
+		log.Info("Using codespace", "codespace", cs.Name, "state", cs.State)
+	}
+
+	cs, err := client.Get(ctx, a.opts.Codespace)
+	if err != nil {
+		return err
+	}
+	if cs.State == codespace.StateAvailable {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, codespaceStartTimeout)
+	defer cancel()
+	var (
+		last     string
+		reported time.Duration
+	)
+	err = client.Wait(ctx, cs.Name, codespacePollInterval, func(state string, waited time.Duration) {
+		if state == last && waited-reported < codespaceProgressInterval {
+			return
+		}
+		last, reported = state, waited
+		if state == codespace.StateAvailable {
+			log.Info("Codespace is available", "codespace", cs.Name, "waited", waited.Round(time.Second))
+			return
+		}
+		log.Info("Waiting for codespace...", "codespace", cs.Name, "state", state, "waited", waited.Round(time.Second))
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("codespace %s was not available after %s", cs.Name, codespaceStartTimeout)
+	}
+	return err
+}
+
+// findCodespace returns the most recently used codespace of opts.Repo, on
+// opts.Branch when set, creating one when there is none and opts.Create is
+// set.
+func (a *App) findCodespace(ctx context.Context, client *codespace.Client) (*codespace.Codespace, error) {
+	cs, err := client.Find(ctx, a.opts.Repo, a.opts.Branch)
+	if !errors.Is(err, codespace.ErrNotFound) {
+		return cs, err
+	}
+
+	target := a.opts.Repo
+	if a.opts.Branch != "" {
+		target += " on " + a.opts.Branch
+	}
+	if !a.opts.Create {
+		return nil, fmt.Errorf("no codespace of %s, use --create to create one", target)
+	}
+	a.log.with("codespace").Info("Creating codespace...", "repo", a.opts.Repo, "branch", a.opts.Branch, "machine", a.opts.Machine)
+	return client.Create(ctx, codespace.CreateOptions{
+		Repo:    a.opts.Repo,
+		Branch:  a.opts.Branch,
+		Machine: a.opts.Machine,
+	})
+}
@@ -0,0 +1,99 @@
+package mosh
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// controlVersion is bumped whenever the control protocol changes in a way
+// older clients cannot understand.
+const controlVersion = 1
+
+// Control message types sent by the server half to the client half.
+const (
+	controlProgress = "progress" // human readable progress update
+	controlConnect  = "connect"  // mosh-server is ready to be paired
+	controlError    = "error"    // the server half failed and is exiting
+)
+
+// controlMessage is one JSON line on the control stream. The server half
+// writes control messages to stdout and keeps its logs on stderr, so the
+// client never has to pick machine readable data out of free-form text.
+type controlMessage struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+
+	Message       string `json:"message,omitempty"`
+	MoshKey       string `json:"mosh_key,omitempty"`
+	RelayAddr     string `json:"relay_addr,omitempty"`
+	ServerVersion string `json:"server_version,omitempty"`
+
+	// Set when the client asked for a direct connection.
+	ServerAddrs []string `json:"server_addrs,omitempty"`
+	ServerPort  int      `json:"server_port,omitempty"`
+	ProbePort   int      `json:"probe_port,omitempty"`
+}
+
+type controlWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newControlWriter(w io.Writer) *controlWriter {
+	return &controlWriter{enc: json.NewEncoder(w)}
+}
+
+func (c *controlWriter) send(msg controlMessage) error {
+	msg.Version = controlVersion
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enc.Encode(msg); err != nil {
+		return fmt.Errorf("failed to write control message: %w", err)
+	}
+	return nil
+}
+
+func (c *controlWriter) progress(message string) error {
+	return c.send(controlMessage{Type: controlProgress, Message: message})
+}
+
+func (c *controlWriter) fail(err error) error {
+	return c.send(controlMessage{Type: controlError, Message: err.Error()})
+}
+
+type controlReader struct {
+	scan *bufio.Scanner
+}
+
+func newControlReader(r io.Reader) *controlReader {
+	return &controlReader{scan: bufio.NewScanner(r)}
+}
+
+// next returns the next control message. Lines that are not control messages
+// are returned as progress so tooling noise on stdout is not lost.
+func (c *controlReader) next() (controlMessage, error) {
+	if !c.scan.Scan() {
+		if err := c.scan.Err(); err != nil {
+			return controlMessage{}, fmt.Errorf("failed to read control stream: %w", err)
+		}
+		return controlMessage{}, io.EOF
+	}
+	line := c.scan.Bytes()
+	var msg controlMessage
+	if err := json.Unmarshal(line, &msg); err != nil || msg.Type == "" {
+		return controlMessage{Version: controlVersion, Type: controlProgress, Message: string(line)}, nil
+	}
+	if msg.Version != controlVersion {
+		return controlMessage{}, fmt.Errorf(
+			"unsupported control protocol version %d, expected %d", msg.Version, controlVersion,
+		)
+	}
+	if msg.Type == controlError {
+		return msg, errors.New(msg.Message)
+	}
+	return msg, nil
+}
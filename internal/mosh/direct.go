@@ -0,0 +1,422 @@
+package mosh
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// directProbeInterval is how often the server host is probed, first to
+	// find a direct path and then to tell it is still alive.
+	directProbeInterval = time.Second
+
+	// directTimeout is how long probes may go unanswered before traffic
+	// goes back to the relay.
+	directTimeout = 5 * time.Second
+
+	// probeBindAttempts is how many ports the responder tries before giving
+	// up on finding one that is free on every advertised address.
+	probeBindAttempts = 5
+)
+
+// Probes are "GH-MOSH-PROBE <nonce> <token>", answered with
+// "GH-MOSH-PROBE-ACK <nonce> <token>". Tokens are derived from the mosh key,
+// so the responder only answers the client of its own session and the
+// client only trusts answers from the server half.
+const (
+	probeCommand    = "GH-MOSH-PROBE "
+	probeAckCommand = "GH-MOSH-PROBE-ACK "
+)
+
+// probeToken authenticates a probe for nonce, or its answer when ack is set.
+func probeToken(moshKey, nonce string, ack bool) string {
+	if ack {
+		return nonceToken("gh-mosh-probe-ack", moshKey, nonce)
+	}
+	return nonceToken("gh-mosh-probe", moshKey, nonce)
+}
+
+// parseProbe returns the nonce of a probe, or answer, for moshKey.
+func parseProbe(p []byte, moshKey string, ack bool) (string, bool) {
+	if ack {
+		return parseNonce(p, probeAckCommand, "gh-mosh-probe-ack", moshKey)
+	}
+	return parseNonce(p, probeCommand, "gh-mosh-probe", moshKey)
+}
+
+// nonceToken authenticates nonce for the session of moshKey. The label
+// keeps the tokens of different messages apart, so none can be reflected
+// as another.
+func nonceToken(label, moshKey, nonce string) string {
+	key := sha256.Sum256([]byte(label + " " + moshKey))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// parseNonce returns the nonce of "<prefix><nonce> <token>" when its token
+// is nonceToken(label, moshKey, nonce).
+func parseNonce(p []byte, prefix, label, moshKey string) (string, bool) {
+	rest, ok := bytes.CutPrefix(p, []byte(prefix))
+	if !ok {
+		return "", false
+	}
+	nonce, token, ok := strings.Cut(string(rest), " ")
+	if !ok || !hmac.Equal([]byte(token), []byte(nonceToken(label, moshKey, nonce))) {
+		return "", false
+	}
+	return nonce, true
+}
+
+// newNonce returns a random nonce for probes and punches.
+func newNonce() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// probeResponder answers the client's probes on the addresses the server
+// half advertises, telling it UDP reaches this host directly.
+type probeResponder struct {
+	log     *logger
+	moshKey string
+	conns   []*net.UDPConn
+}
+
+func newProbeResponder(log *logger, moshKey string) *probeResponder {
+	return &probeResponder{log: log, moshKey: moshKey}
+}
+
+// listen binds the responder on the same port of every address in addrs
+// and returns that port.
+func (p *probeResponder) listen(addrs []string) (int, error) {
+	var err error
+	for i := 0; i < probeBindAttempts; i++ {
+		var port int
+		if port, err = p.bind(addrs); err == nil {
+			return port, nil
+		}
+		p.stop()
+	}
+	return 0, err
+}
+
+func (p *probeResponder) bind(addrs []string) (int, error) {
+	p.conns = nil
+	port := 0
+	for _, addr := range addrs {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(addr), Port: port})
+		if err != nil {
+			return 0, fmt.Errorf("failed to listen udp on %s: %w", addr, err)
+		}
+		p.conns = append(p.conns, conn)
+		port = conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	return port, nil
+}
+
+func (p *probeResponder) serve(ctx context.Context) error {
+	errs := make(chan error, len(p.conns))
+	for _, conn := range p.conns {
+		go func(conn *net.UDPConn) {
+			errs <- p.answer(ctx, conn)
+		}(conn)
+	}
+	return await(ctx, errs)
+}
+
+func (p *probeResponder) answer(ctx context.Context, conn *net.UDPConn) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			b := make([]byte, maxPacketSize)
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return fmt.Errorf("failed to read from udp: %w", err)
+			}
+			nonce, ok := parseProbe(b[:n], p.moshKey, false)
+			if !ok {
+				continue
+			}
+			reply := probeAckCommand + nonce + " " + probeToken(p.moshKey, nonce, true)
+			if _, err := conn.WriteToUDP([]byte(reply), addr); err != nil {
+				return fmt.Errorf("failed to write to udp: %w", err)
+			}
+		}
+	}
+}
+
+func (p *probeResponder) stop() error {
+	var errs []error
+	for _, conn := range p.conns {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// advertisedAddrs returns the addresses of this host the client may be able
+// to reach directly, skipping loopback and link-local addresses.
+func advertisedAddrs() ([]string, error) {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+	return filterAdvertised(ifaceAddrs), nil
+}
+
+func filterAdvertised(ifaceAddrs []net.Addr) []string {
+	var addrs []string
+	for _, a := range ifaceAddrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		addrs = append(addrs, ipnet.IP.String())
+	}
+	return addrs
+}
+
+// directPath sends datagrams straight to mosh-server once the server host
+// answers probes, and back through the relay as soon as the probes go
+// unanswered. The relay stays connected meanwhile, and mosh-server follows
+// whichever path the client's datagrams arrive from.
+type directPath struct {
+	log                   *logger
+	moshKey               string
+	hosts                 []net.IP
+	probePort, serverPort int
+	sender, receiver      chan []byte
+
+	relay              relaySession
+	fromRelay, toRelay chan []byte
+	conn               *net.UDPConn
+
+	mu     sync.Mutex
+	server *net.UDPAddr // mosh-server's address while traffic flows directly
+	seen   time.Time    // last answered probe
+	nonces map[string]time.Time
+}
+
+// openDirect connects to the relays and returns a session that moves
+// traffic onto a direct path to the server host when there is one.
+func (a *App) openDirect(ctx context.Context, moshKey string, details controlMessage, sender, receiver chan []byte) (relaySession, error) {
+	d := &directPath{
+		log:        a.log.with("direct"),
+		moshKey:    moshKey,
+		probePort:  details.ProbePort,
+		serverPort: details.ServerPort,
+		sender:     sender,
+		receiver:   receiver,
+		fromRelay:  make(chan []byte),
+		toRelay:    make(chan []byte),
+		nonces:     make(map[string]time.Time),
+	}
+	for _, addr := range details.ServerAddrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			d.hosts = append(d.hosts, ip)
+		}
+	}
+	if d.probePort == 0 || d.serverPort == 0 || len(d.hosts) == 0 {
+		d.log.Info("Server did not advertise a direct address, using relay")
+		return a.openRelays(ctx, moshKey, sender, receiver)
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen udp: %w", err)
+	}
+	d.conn = conn
+	if d.relay, err = a.openRelays(ctx, moshKey, d.fromRelay, d.toRelay); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *directPath) current() string {
+	return d.relay.current()
+}
+
+func (d *directPath) serve(ctx context.Context) error {
+	errs := make(chan error, 3)
+	go func() {
+		if err := d.relay.serve(ctx); err != nil {
+			errs <- err
+		}
+	}()
+	go func() {
+		if err := d.read(ctx); err != nil {
+			errs <- fmt.Errorf("failed to read: %w", err)
+		}
+	}()
+	go func() {
+		if err := d.write(ctx); err != nil {
+			errs <- fmt.Errorf("failed to write: %w", err)
+		}
+	}()
+	go d.forward(ctx)
+	go d.probe(ctx)
+	return await(ctx, errs)
+}
+
+func (d *directPath) stop() error {
+	return errors.Join(d.relay.stop(), d.conn.Close())
+}
+
+// read forwards datagrams from mosh-server and handles probe answers.
+func (d *directPath) read(ctx context.Context) error {
+	for {
+		p := make([]byte, maxPacketSize)
+		n, from, err := d.conn.ReadFromUDP(p)
+		if err != nil {
+			return fmt.Errorf("failed to read from udp: %w", err)
+		}
+		if !d.isHost(from.IP) {
+			continue
+		}
+		switch from.Port {
+		case d.probePort:
+			d.answered(from, p[:n])
+		case d.serverPort:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case d.sender <- p[:n]:
+			}
+		}
+	}
+}
+
+// forward passes datagrams from the relay to sender.
+func (d *directPath) forward(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-d.fromRelay:
+			select {
+			case <-ctx.Done():
+				return
+			case d.sender <- p:
+			}
+		}
+	}
+}
+
+func (d *directPath) write(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case p := <-d.receiver:
+			if server := d.route(); server != nil {
+				if _, err := d.conn.WriteToUDP(p, server); err != nil {
+					return fmt.Errorf("failed to write to udp: %w", err)
+				}
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case d.toRelay <- p:
+			}
+		}
+	}
+}
+
+// probe keeps probing the server host, every advertised address until one
+// answers and then the one in use.
+func (d *directPath) probe(ctx context.Context) {
+	ticker := time.NewTicker(directProbeInterval)
+	defer ticker.Stop()
+	for {
+		nonce, err := newNonce()
+		if err != nil {
+			d.log.Warn("Failed to generate probe nonce", "err", err)
+			return
+		}
+		probe := []byte(probeCommand + nonce + " " + probeToken(d.moshKey, nonce, false))
+
+		d.mu.Lock()
+		for n, sent := range d.nonces {
+			if time.Since(sent) > directTimeout {
+				delete(d.nonces, n)
+			}
+		}
+		d.nonces[nonce] = time.Now()
+		hosts := d.hosts
+		if d.server != nil {
+			hosts = []net.IP{d.server.IP}
+		}
+		d.mu.Unlock()
+
+		for _, ip := range hosts {
+			if _, err := d.conn.WriteToUDP(probe, &net.UDPAddr{IP: ip, Port: d.probePort}); err != nil {
+				d.log.Debug("Failed to send direct probe", "addr", ip, "err", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// answered records an answer to a recent probe, switching to the direct
+// path through from if none is in use.
+func (d *directPath) answered(from *net.UDPAddr, p []byte) {
+	nonce, ok := parseProbe(p, d.moshKey, true)
+	if !ok {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.nonces[nonce]; !ok {
+		return
+	}
+	delete(d.nonces, nonce)
+	if d.server == nil {
+		d.server = &net.UDPAddr{IP: from.IP, Port: d.serverPort}
+		d.log.Info("Switched to direct path", "server", d.server)
+	}
+	if d.server.IP.Equal(from.IP) {
+		d.seen = time.Now()
+	}
+}
+
+// route returns mosh-server's address while the direct path is alive, and
+// nil once probes have gone unanswered for directTimeout.
+func (d *directPath) route() *net.UDPAddr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.server != nil && time.Since(d.seen) > directTimeout {
+		d.log.Warn("Direct path went quiet, falling back to relay", "server", d.server)
+		d.server = nil
+	}
+	return d.server
+}
+
+func (d *directPath) isHost(ip net.IP) bool {
+	for _, host := range d.hosts {
+		if host.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package mosh
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseProbe(t *testing.T) {
+	probe := []byte(probeCommand + "n1 " + probeToken("key", "n1", false))
+	ack := []byte(probeAckCommand + "n1 " + probeToken("key", "n1", true))
+
+	for _, tt := range []struct {
+		name    string
+		p       []byte
+		moshKey string
+		ack     bool
+		ok      bool
+	}{
+		{"probe", probe, "key", false, true},
+		{"answer", ack, "key", true, true},
+		{"probe of another session", probe, "other", false, false},
+		{"answer of another session", ack, "other", true, false},
+		{"probe taken for an answer", probe, "key", true, false},
+		{"answer taken for a probe", ack, "key", false, false},
+		{"reflected probe", []byte(probeAckCommand + "n1 " + probeToken("key", "n1", false)), "key", true, false},
+		{"no token", []byte(probeCommand + "n1"), "key", false, false},
+		{"mosh datagram", []byte("\x00\x01\x02"), "key", false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			nonce, ok := parseProbe(tt.p, tt.moshKey, tt.ack)
+			if ok != tt.ok || (ok && nonce != "n1") {
+				t.Fatalf("parseProbe = %q, %v, want ok %v", nonce, ok, tt.ok)
+			}
+		})
+	}
+}
+
+// stubRelay stands in for the relay leg, its datagrams exchanged through
+// the directPath's channels.
+type stubRelay struct{}
+
+func (stubRelay) serve(ctx context.Context) error { <-ctx.Done(); return nil }
+func (stubRelay) stop() error                     { return nil }
+func (stubRelay) current() string                 { return "relay" }
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestDirectPathSwitchesAndFallsBack(t *testing.T) {
+	const moshKey = "mosh key"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	responder := newProbeResponder(testLogger(), moshKey)
+	probePort, err := responder.listen([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.stop()
+	server := listenLoopback(t) // stands in for mosh-server
+
+	d := &directPath{
+		log:        testLogger(),
+		moshKey:    moshKey,
+		hosts:      []net.IP{net.IPv4(127, 0, 0, 1)},
+		probePort:  probePort,
+		serverPort: server.LocalAddr().(*net.UDPAddr).Port,
+		sender:     make(chan []byte),
+		receiver:   make(chan []byte),
+		relay:      stubRelay{},
+		fromRelay:  make(chan []byte),
+		toRelay:    make(chan []byte),
+		conn:       listenLoopback(t),
+		nonces:     make(map[string]time.Time),
+	}
+	go d.serve(ctx)
+
+	// Unanswered probes keep traffic on the relay.
+	d.receiver <- []byte("one")
+	if got := receive(t, d.toRelay); got != "one" {
+		t.Fatalf("relay got %q, want one", got)
+	}
+
+	responderCtx, stopResponder := context.WithCancel(ctx)
+	go responder.serve(responderCtx)
+	waitRoute(t, d, true, 3*time.Second)
+	d.receiver <- []byte("two")
+	if got := readFrom(t, server); got != "two" {
+		t.Fatalf("server got %q, want two", got)
+	}
+
+	// Both paths reach mosh-client, mosh-server answers wherever the last
+	// datagram came from.
+	if _, err := server.WriteToUDP([]byte("from server"), d.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, d.sender); got != "from server" {
+		t.Fatalf("client got %q", got)
+	}
+	d.fromRelay <- []byte("from relay")
+	if got := receive(t, d.sender); got != "from relay" {
+		t.Fatalf("client got %q", got)
+	}
+
+	stopResponder()
+	responder.stop()
+	waitRoute(t, d, false, directTimeout+3*time.Second)
+	d.receiver <- []byte("three")
+	if got := receive(t, d.toRelay); got != "three" {
+		t.Fatalf("relay got %q, want three", got)
+	}
+}
+
+func waitRoute(t *testing.T, d *directPath, direct bool, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for (d.route() != nil) != direct {
+		if time.Now().After(deadline) {
+			t.Fatalf("direct path in use is not %v after %s", direct, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func readFrom(t *testing.T, conn *net.UDPConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p := make([]byte, maxPacketSize)
+	n, _, err := conn.ReadFromUDP(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p[:n])
+}
+
+func TestFilterAdvertised(t *testing.T) {
+	ipnet := func(s string) net.Addr {
+		ip, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.IP = ip
+		return n
+	}
+	for _, tt := range []struct {
+		name  string
+		addrs []net.Addr
+		want  []string
+	}{
+		{"none", nil, nil},
+		{"loopback", []net.Addr{ipnet("127.0.0.1/8"), ipnet("::1/128")}, nil},
+		{"link-local", []net.Addr{ipnet("169.254.1.2/16"), ipnet("fe80::1/64")}, nil},
+		{
+			"routable",
+			[]net.Addr{ipnet("127.0.0.1/8"), ipnet("10.0.0.5/24"), ipnet("fe80::1/64"), ipnet("2001:db8::5/64")},
+			[]string{"10.0.0.5", "2001:db8::5"},
+		},
+		{"not an IP network", []net.Addr{&net.UnixAddr{Name: "/tmp/sock"}}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterAdvertised(tt.addrs)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("filterAdvertised = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package mosh
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Rendezvous and hole punching commands. RENDEZVOUS is sent to the relay,
+// which answers with PEER and the public endpoint it observed for the other
+// half of the pair. "PUNCH <nonce> <token>" and "PUNCH-ACK <nonce> <token>"
+// are exchanged directly between peers, authenticated like direct probes.
+const (
+	rendezvousCommand = "RENDEZVOUS"
+	peerCommand       = "PEER "
+	punchCommand      = "PUNCH "
+	punchAckCommand   = "PUNCH-ACK "
+)
+
+const (
+	rendezvousTimeout = 10 * time.Second
+	punchInterval     = 200 * time.Millisecond
+
+	// peerTimeout is how long the peer-to-peer path may stay silent before
+	// traffic goes back to the relay. Both mosh ends send heartbeats every
+	// few seconds, so a healthy path is never this quiet.
+	peerTimeout = 10 * time.Second
+
+	// relayKeepalive refreshes the relay pairing, and the NAT mapping
+	// towards the relay, while traffic flows peer to peer or directly.
+	relayKeepalive = 20 * time.Second
+)
+
+// punchPeer punches a peer-to-peer path, and punches a new one whenever
+// the path in use goes quiet.
+func (r *relayServerClient) punchPeer(ctx context.Context) {
+	for {
+		r.holePunch(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.peerLost:
+		}
+	}
+}
+
+// holePunch asks the relay for the peer's endpoint and punches a path to
+// it. Traffic keeps flowing through the relay until the path is confirmed.
+func (r *relayServerClient) holePunch(ctx context.Context) {
+	punchCtx, cancel := context.WithTimeout(ctx, rendezvousTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(punchInterval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-punchCtx.Done():
+			r.log.Info("Peer-to-peer path unavailable, staying on relay")
+			return
+		case <-ticker.C:
+		}
+
+		if r.currentPeer() != nil {
+			return
+		}
+		candidate := r.currentCandidate()
+		if candidate == nil {
+			if i%5 == 0 { // once a second
+				r.conn.WriteToUDP([]byte(rendezvousCommand), r.remoteAddr)
+			}
+			continue
+		}
+		nonce, err := newNonce()
+		if err != nil {
+			r.log.Warn("Failed to generate punch nonce", "err", err)
+			return
+		}
+		r.mu.Lock()
+		for n, sent := range r.punches {
+			if time.Since(sent) > rendezvousTimeout {
+				delete(r.punches, n)
+			}
+		}
+		r.punches[nonce] = time.Now()
+		r.mu.Unlock()
+		r.conn.WriteToUDP([]byte(punchCommand+nonce+" "+punchToken(r.moshKey, nonce, false)), candidate)
+	}
+}
+
+// keepRelayAlive resends CONNECT whenever nothing was sent to the relay for
+// relayKeepalive, as while traffic flows peer to peer or directly, so
+// falling back to the relay does not need a new pairing.
+func (r *relayServerClient) keepRelayAlive(ctx context.Context) {
+	ticker := time.NewTicker(relayKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			idle := time.Since(r.relaySent) >= relayKeepalive
+			r.mu.Unlock()
+			if !idle {
+				continue
+			}
+			if err := r.sendConnect(ctx); err != nil {
+				r.log.Debug("Relay keepalive failed", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// punchToken proves to the peer that a punch for nonce, or its answer when
+// ack is set, comes from the other half of the same session.
+func punchToken(moshKey, nonce string, ack bool) string {
+	if ack {
+		return nonceToken("gh-mosh-punch-ack", moshKey, nonce)
+	}
+	return nonceToken("gh-mosh-punch", moshKey, nonce)
+}
+
+func (r *relayServerClient) setCandidate(p []byte) {
+	endpoint := strings.TrimSpace(strings.TrimPrefix(string(p), peerCommand))
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		r.log.Warn("Relay sent an invalid peer endpoint", "endpoint", endpoint)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.candidate == nil {
+		r.log.Debug("Relay reported peer endpoint", "addr", addr)
+	}
+	r.candidate = addr
+}
+
+// handlePunch answers punch packets and reports whether p was one. A path
+// is only confirmed by the answer to an outstanding punch, from the
+// endpoint the relay reported, so neither replayed answers nor answers from
+// elsewhere can divert traffic.
+func (r *relayServerClient) handlePunch(from *net.UDPAddr, p []byte) bool {
+	switch {
+	case bytes.HasPrefix(p, []byte(punchCommand)):
+		if nonce, ok := parseNonce(p, punchCommand, "gh-mosh-punch", r.moshKey); ok {
+			r.conn.WriteToUDP([]byte(punchAckCommand+nonce+" "+punchToken(r.moshKey, nonce, true)), from)
+		}
+		return true
+	case bytes.HasPrefix(p, []byte(punchAckCommand)):
+		nonce, ok := parseNonce(p, punchAckCommand, "gh-mosh-punch-ack", r.moshKey)
+		if !ok {
+			return true
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if _, ok := r.punches[nonce]; !ok || r.candidate == nil || !sameAddr(from, r.candidate) {
+			return true
+		}
+		delete(r.punches, nonce)
+		if r.peer == nil {
+			r.log.Info("Switched to peer-to-peer path", "peer", from)
+		}
+		r.peer, r.peerSeen = from, time.Now()
+		return true
+	}
+	return false
+}
+
+// fromPeer reports whether from is the established peer and records that
+// the path is alive.
+func (r *relayServerClient) fromPeer(from *net.UDPAddr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peer == nil || !sameAddr(from, r.peer) {
+		return false
+	}
+	r.peerSeen = time.Now()
+	return true
+}
+
+// route returns where the next datagram should be sent, dropping the
+// peer-to-peer path once it has gone quiet. The peer's endpoint may have
+// changed, so punchPeer asks the relay for it again.
+func (r *relayServerClient) route() *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peer != nil && time.Since(r.peerSeen) > peerTimeout {
+		r.log.Warn("Peer-to-peer path went quiet, falling back to relay", "peer", r.peer)
+		r.peer, r.candidate = nil, nil
+		select {
+		case r.peerLost <- struct{}{}:
+		default:
+		}
+	}
+	if r.peer != nil {
+		return r.peer
+	}
+	return r.remoteAddr
+}
+
+func (r *relayServerClient) currentPeer() *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.peer
+}
+
+func (r *relayServerClient) currentCandidate() *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.candidate
+}
@@ -0,0 +1,105 @@
+package mosh
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newPunchTest returns a client with peer as the endpoint the relay
+// reported, and the connection of that peer.
+func newPunchTest(t *testing.T) (*relayServerClient, *net.UDPConn) {
+	t.Helper()
+	peer := listenLoopback(t)
+	c := newRelayServerClient(testLogger(), "key", "mosh key", listenLoopback(t).LocalAddr().(*net.UDPAddr), true, nil, nil)
+	c.conn = listenLoopback(t)
+	c.candidate = peer.LocalAddr().(*net.UDPAddr)
+	return c, peer
+}
+
+func punchAck(moshKey, nonce string) []byte {
+	return []byte(punchAckCommand + nonce + " " + punchToken(moshKey, nonce, true))
+}
+
+func TestPunchAnswered(t *testing.T) {
+	c, peer := newPunchTest(t)
+	from := peer.LocalAddr().(*net.UDPAddr)
+	if !c.handlePunch(from, []byte(punchCommand+"n1 "+punchToken("mosh key", "n1", false))) {
+		t.Fatal("punch not handled")
+	}
+	if got := readFrom(t, peer); got != string(punchAck("mosh key", "n1")) {
+		t.Fatalf("peer got %q", got)
+	}
+
+	// Punches of another session, and answers reflected as punches, are
+	// consumed without an answer.
+	for _, p := range []string{
+		punchCommand + "n2 " + punchToken("other key", "n2", false),
+		punchCommand + "n3 " + punchToken("mosh key", "n3", true),
+	} {
+		if !c.handlePunch(from, []byte(p)) {
+			t.Fatalf("%q not handled", p)
+		}
+	}
+	peer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := peer.ReadFromUDP(make([]byte, maxPacketSize)); err == nil {
+		t.Fatal("answered an invalid punch")
+	}
+}
+
+func TestPunchAckReplayed(t *testing.T) {
+	c, peer := newPunchTest(t)
+	from := peer.LocalAddr().(*net.UDPAddr)
+	c.punches["n1"] = time.Now()
+
+	c.handlePunch(from, punchAck("mosh key", "n1"))
+	if c.currentPeer() == nil {
+		t.Fatal("answer to an outstanding punch not accepted")
+	}
+
+	c.peer = nil
+	for _, p := range [][]byte{
+		punchAck("mosh key", "n1"),  // replayed
+		punchAck("mosh key", "n2"),  // never sent
+		punchAck("other key", "n1"), // another session
+	} {
+		c.handlePunch(from, p)
+		if c.currentPeer() != nil {
+			t.Fatalf("accepted %q", p)
+		}
+	}
+}
+
+func TestPunchAckFromWrongAddress(t *testing.T) {
+	c, peer := newPunchTest(t)
+	c.punches["n1"] = time.Now()
+
+	attacker := listenLoopback(t).LocalAddr().(*net.UDPAddr)
+	c.handlePunch(attacker, punchAck("mosh key", "n1"))
+	if c.currentPeer() != nil {
+		t.Fatalf("accepted an answer from %s, want only %s", attacker, c.candidate)
+	}
+
+	// The punch is still outstanding for the real peer.
+	c.handlePunch(peer.LocalAddr().(*net.UDPAddr), punchAck("mosh key", "n1"))
+	if got := c.currentPeer(); got == nil || !sameAddr(got, c.candidate) {
+		t.Fatalf("peer = %v, want %s", got, c.candidate)
+	}
+}
+
+func TestQuietPeerPunchesAgain(t *testing.T) {
+	c, peer := newPunchTest(t)
+	c.peer, c.peerSeen = peer.LocalAddr().(*net.UDPAddr), time.Now().Add(-2*peerTimeout)
+
+	if to := c.route(); to != c.remoteAddr {
+		t.Fatalf("route = %s, want the relay", to)
+	}
+	if c.currentCandidate() != nil {
+		t.Fatal("kept the quiet peer's endpoint")
+	}
+	select {
+	case <-c.peerLost:
+	default:
+		t.Fatal("hole punching not restarted")
+	}
+}
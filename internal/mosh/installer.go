@@ -10,28 +10,41 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/Masterminds/semver"
 )
 
 const moshRepository = "https://github.com/mobile-shell/mosh"
 
+// Install policies applied when mosh is missing or incompatible.
+const (
+	InstallAuto  = "auto"  // download and build mosh from source
+	InstallNever = "never" // fail and leave installing to the user
+)
+
 type process interface {
 	installed() bool
 	version(context.Context) (*semver.Version, error)
 }
 
 type installer struct {
-	p process
+	log    *logger
+	p      process
+	policy string
 }
 
-func newInstaller(p process) *installer {
-	return &installer{p}
+func newInstaller(log *logger, p process, policy string) *installer {
+	return &installer{log: log, p: p, policy: policy}
 }
 
 func (ins *installer) ensureCompatible(ctx context.Context) error {
 	processInstalled := ins.p.installed()
 	if !processInstalled {
+		if ins.policy == InstallNever {
+			return fmt.Errorf("mosh %s is not installed and the install policy is %q", moshVersion, ins.policy)
+		}
+		ins.log.Info("mosh is not installed, installing", "version", moshVersion)
 		return ins.install(ctx)
 	}
 	processVersion, err := ins.p.version(ctx)
@@ -43,6 +56,13 @@ func (ins *installer) ensureCompatible(ctx context.Context) error {
 		return fmt.Errorf("invalid mosh version requirement: %w", err)
 	}
 	if !versionReq.Check(processVersion) {
+		if ins.policy == InstallNever {
+			return fmt.Errorf(
+				"mosh %s is required but %s is installed and the install policy is %q",
+				moshVersion, processVersion, ins.policy,
+			)
+		}
+		ins.log.Info("mosh version is incompatible, installing", "found", processVersion, "version", moshVersion)
 		return ins.install(ctx)
 	}
 	return nil
@@ -72,7 +92,7 @@ func (ins *installer) install(ctx context.Context) (err error) {
 	}
 	defer func() {
 		if err := os.Remove(dest); err != nil {
-			fmt.Println("failed to remove mosh download:", err)
+			ins.log.Warn("failed to remove mosh download", "err", err)
 		}
 	}()
 	extractDir, err := extractTarball(dest)
@@ -81,10 +101,10 @@ func (ins *installer) install(ctx context.Context) (err error) {
 	}
 	defer func() {
 		if err := os.RemoveAll(extractDir); err != nil {
-			fmt.Println("failed to remove mosh download extract dir:", err)
+			ins.log.Warn("failed to remove mosh download extract dir", "err", err)
 		}
 	}()
-	return installMosh(ctx, extractDir)
+	return installMosh(ctx, ins.log, extractDir)
 }
 
 func extractTarball(p string) (string, error) {
@@ -127,19 +147,20 @@ func extractTarball(p string) (string, error) {
 	return filepath.Join(extractDir, packageName()), nil
 }
 
-func installMosh(ctx context.Context, p string) error {
+func installMosh(ctx context.Context, log *logger, p string) error {
 	steps := [][]string{
 		{"./configure"}, {"make"}, {"make", "install"},
 	}
 	for i, step := range steps {
-		if err := runCmd(ctx, p, step...); err != nil {
+		log.Info("Running install step", "dir", p, "cmd", strings.Join(step, " "))
+		if err := runCmd(ctx, log, p, step...); err != nil {
 			return fmt.Errorf("failed to run step %d: %w", i, err)
 		}
 	}
 	return nil
 }
 
-func runCmd(ctx context.Context, p string, c ...string) error {
+func runCmd(ctx context.Context, log *logger, p string, c ...string) error {
 	if len(c) == 0 {
 		return fmt.Errorf("no command provided")
 	}
@@ -148,8 +169,8 @@ func runCmd(ctx context.Context, p string, c ...string) error {
 		cmd.Args = append(cmd.Args, c[1:]...)
 	}
 	cmd.Dir = p
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
+	cmd.Stderr = log.lineWriter(LevelDebug)
+	cmd.Stdout = log.lineWriter(LevelDebug)
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start command: %w", err)
 	}
@@ -0,0 +1,94 @@
+package mosh
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Remote names the host the server half runs on: a codespace, an SSH
+// destination, or this host when both are empty, for development.
+type Remote struct {
+	Codespace string
+	SSH       string // user@host, or ssh://user@host:port
+}
+
+// String names the remote for display, "" for this host.
+func (r Remote) String() string {
+	if r.SSH != "" {
+		return "ssh:" + r.SSH
+	}
+	return r.Codespace
+}
+
+func (r Remote) local() bool {
+	return r.Codespace == "" && r.SSH == ""
+}
+
+func (r Remote) launcher() remoteLauncher {
+	switch {
+	case r.SSH != "":
+		return sshLauncher{dest: r.SSH}
+	case r.Codespace != "":
+		return codespaceLauncher{codespace: r.Codespace}
+	default:
+		return localLauncher{}
+	}
+}
+
+// remoteLauncher runs gh-mosh on the remote host. The relay carries the
+// session, so all a launcher needs is a way to run a command there and read
+// its output, without any inbound UDP to the host.
+type remoteLauncher interface {
+	// command returns the command running gh-mosh with args on the
+	// remote host, env added to its environment.
+	command(ctx context.Context, env, args []string) *exec.Cmd
+}
+
+// codespaceLauncher runs gh-mosh in a codespace through gh's SSH tunnel.
+type codespaceLauncher struct {
+	codespace string
+}
+
+func (l codespaceLauncher) command(ctx context.Context, env, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "gh", "codespace", "ssh", "-c", l.codespace, "--", remoteShellCommand([]string{"gh", "mosh"}, env, args))
+	cmd.Env = childEnv()
+	return cmd
+}
+
+// sshLauncher runs gh-mosh on any host the user can reach with ssh, using
+// their own ssh configuration, keys and agent. The host needs the gh-mosh
+// binary on its PATH, not gh.
+type sshLauncher struct {
+	dest string
+}
+
+func (l sshLauncher) command(ctx context.Context, env, args []string) *exec.Cmd {
+	// No pseudo-terminal, stdout carries the control stream. The
+	// destination follows "--" so it is never taken for an option.
+	cmd := exec.CommandContext(ctx, "ssh", "-T", "--", l.dest, remoteShellCommand([]string{"gh-mosh"}, env, args))
+	cmd.Env = childEnv()
+	return cmd
+}
+
+// localLauncher runs gh-mosh from the current working tree, for
+// development.
+type localLauncher struct{}
+
+func (localLauncher) command(ctx context.Context, env, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "go", "run", "gh-mosh.go")
+	cmd.Args = append(cmd.Args, args...)
+	cmd.Env = append(childEnv(), env...)
+	return cmd
+}
+
+// remoteShellCommand returns the command line a remote login shell runs
+// gh-mosh with, program being how it is invoked there.
+func remoteShellCommand(program, env, args []string) string {
+	var remote []string
+	if len(env) > 0 {
+		remote = append([]string{"env"}, env...)
+	}
+	remote = append(remote, program...)
+	remote = append(remote, args...)
+	return shellJoin(remote)
+}
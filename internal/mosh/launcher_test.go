@@ -0,0 +1,29 @@
+package mosh
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestSSHLauncherCommand(t *testing.T) {
+	dest := "-oProxyCommand=touch /tmp/pwned"
+	cmd := sshLauncher{dest: dest}.command(context.Background(), []string{"SERVER=true"}, []string{"--session=abc"})
+	want := []string{"ssh", "-T", "--", dest, "'env' 'SERVER=true' 'gh-mosh' '--session=abc'"}
+	if !slices.Equal(cmd.Args, want) {
+		t.Fatalf("args = %q, want %q", cmd.Args, want)
+	}
+}
+
+func TestRemoteLaunchersHideAPIKey(t *testing.T) {
+	t.Setenv("API_KEY", "env-key")
+	for _, l := range []remoteLauncher{codespaceLauncher{codespace: "cs"}, sshLauncher{dest: "host"}} {
+		cmd := l.command(context.Background(), nil, nil)
+		if cmd.Env == nil {
+			t.Fatalf("%T inherits the whole environment", l)
+		}
+		if slices.Contains(cmd.Env, "API_KEY=env-key") {
+			t.Fatalf("%T passes API_KEY to its command", l)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package mosh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errLocked = errors.New("locked by another process")
+
+// lockFile only opens path, file locks are not supported here.
+func lockFile(path string, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	return f, nil
+}
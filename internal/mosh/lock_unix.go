@@ -0,0 +1,36 @@
+//go:build unix
+
+package mosh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// errLocked is returned by lockFile when another process holds the lock
+// and wait is not set.
+var errLocked = errors.New("locked by another process")
+
+// lockFile takes an exclusive lock on path, creating it if needed, and
+// returns the file to close to release it. The lock goes away with the
+// process, so a crash never leaves it behind.
+func lockFile(path string, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLocked
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,215 @@
+package mosh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log record. The values leave room between
+// levels the same way log/slog does, so the zero value is LevelInfo.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+func (l LogLevel) String() string {
+	switch {
+	case l <= LevelDebug:
+		return "DEBUG"
+	case l <= LevelInfo:
+		return "INFO"
+	case l <= LevelWarn:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// logger writes leveled records tagged with the component that produced
+// them. Loggers derived with with share their output, level and secrets.
+// Any registered secret is replaced by its fingerprint before it reaches the
+// output, unless showSecrets is set.
+type logger struct {
+	*logOutput
+	component string
+}
+
+type logOutput struct {
+	out         io.Writer
+	showSecrets bool
+	quietable   bool // records below LevelWarn stop once the TTY is handed off
+
+	mu      sync.Mutex
+	level   LogLevel
+	secrets []string
+}
+
+func newLogger(out io.Writer, level LogLevel, quietable, showSecrets bool) *logger {
+	return &logger{
+		logOutput: &logOutput{out: out, level: level, quietable: quietable, showSecrets: showSecrets},
+		component: "app",
+	}
+}
+
+// with returns a logger for component sharing l's output.
+func (l *logger) with(component string) *logger {
+	return &logger{logOutput: l.logOutput, component: component}
+}
+
+// handoff is called when mosh-client takes over the terminal. From then on
+// a quietable logger only writes warnings and errors, anything else would be
+// drawn over the mosh session.
+func (l *logger) handoff() {
+	if !l.quietable {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.level < LevelWarn {
+		l.level = LevelWarn
+	}
+}
+
+// addSecret registers a value that must never be printed in full.
+func (l *logger) addSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.secrets {
+		if s == secret {
+			return
+		}
+	}
+	l.secrets = append(l.secrets, secret)
+}
+
+func (l *logger) Debug(msg string, attrs ...interface{}) { l.log(LevelDebug, msg, attrs...) }
+func (l *logger) Info(msg string, attrs ...interface{})  { l.log(LevelInfo, msg, attrs...) }
+func (l *logger) Warn(msg string, attrs ...interface{})  { l.log(LevelWarn, msg, attrs...) }
+func (l *logger) Error(msg string, attrs ...interface{}) { l.log(LevelError, msg, attrs...) }
+
+// log formats a record as
+//
+//	15:04:05.000 INFO  [component] message key=value ...
+//
+// attrs are alternating keys and values.
+func (l *logger) log(level LogLevel, msg string, attrs ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s [%s] %s", time.Now().Format("15:04:05.000"), level, l.component, msg)
+	for i := 0; i < len(attrs); i += 2 {
+		if i+1 == len(attrs) {
+			fmt.Fprintf(&b, " %v", attrs[i])
+			break
+		}
+		v := fmt.Sprint(attrs[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %v=%s", attrs[i], v)
+	}
+	b.WriteByte('\n')
+	io.WriteString(l.out, l.redact(b.String()))
+}
+
+// redact must be called with mu held.
+func (l *logger) redact(s string) string {
+	if l.showSecrets {
+		return s
+	}
+	for _, secret := range l.secrets {
+		s = strings.ReplaceAll(s, secret, "<redacted "+Fingerprint(secret)+">")
+	}
+	return s
+}
+
+// Fingerprint is what a secret is redacted to, a short hash of it.
+func Fingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+// lineWriter returns a writer that logs each complete line of output from
+// another process as a record at level.
+func (l *logger) lineWriter(level LogLevel) io.Writer {
+	return &lineWriter{log: l, level: level}
+}
+
+// forwardWriter returns a writer for the logs of another gh-mosh process.
+// Its records keep their level and component, anything else it writes is
+// logged at LevelInfo.
+func (l *logger) forwardWriter() io.Writer {
+	return &lineWriter{log: l, level: LevelInfo, forward: true}
+}
+
+type lineWriter struct {
+	log     *logger
+	level   LogLevel
+	forward bool // parse lines as gh-mosh records
+	buf     bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := strings.TrimRight(string(w.buf.Next(i+1)), "\r\n")
+		if w.forward {
+			if level, component, msg, ok := parseRecord(line); ok {
+				w.log.with(w.log.component+"/"+component).log(level, msg)
+				continue
+			}
+		}
+		w.log.log(w.level, line)
+	}
+}
+
+// parseRecord splits a line written by logger.log into its level, component
+// and the message with its attributes, dropping the timestamp.
+func parseRecord(line string) (level LogLevel, component, msg string, ok bool) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return 0, "", "", false
+	}
+	if _, err := time.Parse("15:04:05.000", fields[0]); err != nil {
+		return 0, "", "", false
+	}
+	switch fields[1] {
+	case "DEBUG":
+		level = LevelDebug
+	case "INFO":
+		level = LevelInfo
+	case "WARN":
+		level = LevelWarn
+	case "ERROR":
+		level = LevelError
+	default:
+		return 0, "", "", false
+	}
+	rest := strings.TrimLeft(fields[2], " ") // levels are padded to five
+	if !strings.HasPrefix(rest, "[") {
+		return 0, "", "", false
+	}
+	component, msg, ok = strings.Cut(rest[1:], "] ")
+	return level, component, msg, ok
+}
@@ -0,0 +1,58 @@
+package mosh
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestForwardWriterKeepsRemoteLevels(t *testing.T) {
+	var remote bytes.Buffer
+	remoteLog := newLogger(&remote, LevelDebug, false, false).with("relay")
+	remoteLog.Debug("Sent connect", "relay", "127.0.0.1:1")
+	remoteLog.Error("Relay failed", "err", "boom")
+	remote.WriteString("Warning: Permanently added 'host' to the list of known hosts.\n")
+
+	var local bytes.Buffer
+	localLog := newLogger(&local, LevelDebug, true, false).with("remote")
+	localLog.handoff() // only warnings and errors from here on
+	if _, err := localLog.forwardWriter().Write(remote.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(local.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want only the error:\n%s", len(lines), local.String())
+	}
+	for _, want := range []string{"ERROR", "[remote/relay] Relay failed err=boom"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("%q does not contain %q", lines[0], want)
+		}
+	}
+	if strings.Count(lines[0], ":") != 2 {
+		t.Errorf("%q carries the remote timestamp", lines[0])
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	for _, tt := range []struct {
+		line      string
+		level     LogLevel
+		component string
+		msg       string
+		ok        bool
+	}{
+		{"04:06:06.719 INFO  [agent] Listening socket=/tmp/a.sock", LevelInfo, "agent", "Listening socket=/tmp/a.sock", true},
+		{"04:06:06.719 WARN  [relay] Not verifying", LevelWarn, "relay", "Not verifying", true},
+		{"04:06:06.719 ERROR [app] failed", LevelError, "app", "failed", true},
+		{"04:06:06.719 DEBUG [app] x", LevelDebug, "app", "x", true},
+		{"Connection to host closed.", 0, "", "", false},
+		{"04:06:06.719 LOUD  [app] x", 0, "", "", false},
+		{"04:06:06.719 INFO  no component", 0, "", "", false},
+	} {
+		level, component, msg, ok := parseRecord(tt.line)
+		if ok != tt.ok || level != tt.level || component != tt.component || msg != tt.msg {
+			t.Errorf("parseRecord(%q) = %v, %q, %q, %v", tt.line, level, component, msg, ok)
+		}
+	}
+}
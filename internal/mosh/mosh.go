@@ -1,10 +1,14 @@
 package mosh
 
-import "context"
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+)
 
 const moshVersion = "1.4.0"
 const maxPacketSize = 1500
-const moshKeyPrefix = "MOSH_KEY"
 
 func await(ctx context.Context, errs chan error) error {
 	select {
@@ -14,3 +18,27 @@ func await(ctx context.Context, errs chan error) error {
 		return err
 	}
 }
+
+// secretEnv names the environment variables childEnv leaves out.
+var secretEnv = []string{"API_KEY"}
+
+// HideEnv keeps the environment variable name out of child processes, for
+// one a profile reads the relay API key from.
+func HideEnv(name string) {
+	if name != "" {
+		secretEnv = append(secretEnv, name)
+	}
+}
+
+// childEnv returns the environment for child processes, without the relay
+// API key a user may have exported.
+func childEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if !slices.Contains(secretEnv, name) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,26 @@
+package mosh
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChildEnvHidesAPIKeys(t *testing.T) {
+	t.Setenv("API_KEY", "env-key")
+	t.Setenv("WORK_RELAY_KEY", "profile-key")
+	t.Setenv("WORK_RELAY_KEY_HINT", "kept")
+	defer func(names []string) { secretEnv = names }(slices.Clone(secretEnv))
+	HideEnv("WORK_RELAY_KEY")
+	HideEnv("")
+
+	env := childEnv()
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "API_KEY=") || strings.HasPrefix(kv, "WORK_RELAY_KEY=") {
+			t.Errorf("child environment has %s", kv)
+		}
+	}
+	if !slices.Contains(env, "WORK_RELAY_KEY_HINT=kept") {
+		t.Error("child environment lost an unrelated variable")
+	}
+}
@@ -0,0 +1,180 @@
+package mosh
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+// multipathWindow is how many recent datagrams are remembered to drop their
+// duplicates, well over a round trip's worth of mosh traffic.
+const multipathWindow = 256
+
+// dedupWindow remembers the most recent datagrams seen. mosh encrypts every
+// datagram with a fresh nonce, so two identical datagrams are copies of the
+// same one that took different paths.
+type dedupWindow struct {
+	mu   sync.Mutex
+	seen map[uint64]int // datagram hash to the number of copies in ring
+	ring [multipathWindow]uint64
+	next int
+	full bool
+}
+
+func newDedupWindow() *dedupWindow {
+	return &dedupWindow{seen: make(map[uint64]int)}
+}
+
+// first reports whether p has not been seen within the window.
+func (d *dedupWindow) first(p []byte) bool {
+	h := fnv.New64a()
+	h.Write(p)
+	sum := h.Sum64()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen[sum] > 0 {
+		return false
+	}
+	if d.full {
+		old := d.ring[d.next]
+		if d.seen[old]--; d.seen[old] == 0 {
+			delete(d.seen, old)
+		}
+	}
+	d.ring[d.next] = sum
+	d.seen[sum]++
+	d.next = (d.next + 1) % multipathWindow
+	d.full = d.full || d.next == 0
+	return true
+}
+
+// relayMultipath sends every datagram through each of its relays and
+// forwards the first copy received. It trades bandwidth for latency on
+// lossy links, as a datagram only needs one path to get through. Both halves
+// use the first relays available in the selected order, so they share the
+// same paths. Each path fails over like a single relay would, to the relays
+// no other path is on.
+type relayMultipath struct {
+	log              *logger
+	sender, receiver chan []byte
+	paths            []*multipathPath
+	dedup            *dedupWindow
+}
+
+type multipathPath struct {
+	failover          *relayFailover
+	inbound, outbound chan []byte
+}
+
+// multipathPaths is how many relays each datagram is sent through.
+const multipathPaths = 2
+
+func (a *App) openMultipath(ctx context.Context, moshKey string, sender, receiver chan []byte) (*relayMultipath, error) {
+	m := &relayMultipath{
+		log:      a.log.with("multipath"),
+		sender:   sender,
+		receiver: receiver,
+		dedup:    newDedupWindow(),
+	}
+	var errs []error
+	for next := 0; len(m.paths) < multipathPaths; {
+		// A stalled path must not hold up the others, so outgoing
+		// datagrams are queued and dropped once the queue is full.
+		path := &multipathPath{inbound: make(chan []byte), outbound: make(chan []byte, maxPendingPackets)}
+		path.failover = a.newFailover(moshKey, path.inbound, path.outbound)
+		path.failover.skip = func(relay string) bool { return m.onOtherPath(path, relay) }
+		if err := path.failover.open(ctx, next); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		m.paths = append(m.paths, path)
+		next = path.failover.index + 1
+	}
+	if len(m.paths) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(m.paths) < multipathPaths {
+		m.log.Warn("Only one relay available, not duplicating datagrams", "relay", m.paths[0].failover.current())
+	}
+	return m, nil
+}
+
+// onOtherPath reports whether a path other than path is on relay.
+func (m *relayMultipath) onOtherPath(path *multipathPath, relay string) bool {
+	for _, other := range m.paths {
+		if other != path && other.failover.current() == relay {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *relayMultipath) current() string {
+	relays := make([]string, len(m.paths))
+	for i, path := range m.paths {
+		relays[i] = path.failover.current()
+	}
+	return strings.Join(relays, ",")
+}
+
+// serve relays datagrams, each path failing over on its own, until ctx is
+// done or a path can no longer fail over.
+func (m *relayMultipath) serve(ctx context.Context) error {
+	errs := make(chan error, len(m.paths))
+	for _, path := range m.paths {
+		go func(path *multipathPath) {
+			errs <- path.failover.serve(ctx)
+		}(path)
+		go m.fanIn(ctx, path)
+	}
+	go m.fanOut(ctx)
+	return await(ctx, errs)
+}
+
+// fanIn forwards the first copy of each datagram arriving on path.
+func (m *relayMultipath) fanIn(ctx context.Context, path *multipathPath) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-path.inbound:
+			if !m.dedup.first(p) {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case m.sender <- p:
+			}
+		}
+	}
+}
+
+// fanOut queues every outgoing datagram on each path.
+func (m *relayMultipath) fanOut(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-m.receiver:
+			for _, path := range m.paths {
+				select {
+				case path.outbound <- p:
+				default:
+					m.log.Debug("Dropping datagram for stalled path", "relay", path.failover.current())
+				}
+			}
+		}
+	}
+}
+
+func (m *relayMultipath) stop() error {
+	var errs []error
+	for _, path := range m.paths {
+		errs = append(errs, path.failover.stop())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,106 @@
+package mosh
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDedupWindow(t *testing.T) {
+	// Fills the window after "a", which is then forgotten.
+	var wrap []string
+	for i := 0; i < multipathWindow; i++ {
+		wrap = append(wrap, strconv.Itoa(i))
+	}
+
+	for _, tt := range []struct {
+		name  string
+		in    []string
+		first []bool // of the last len(first) datagrams
+	}{
+		{"distinct", []string{"a", "b", "c"}, []bool{true, true, true}},
+		{"duplicates", []string{"a", "a", "b", "a", "b"}, []bool{true, false, true, false, false}},
+		{"reordered", []string{"a", "b", "c", "b", "a", "c"}, []bool{true, true, true, false, false, false}},
+		{"wraparound", append(append([]string{"a"}, wrap...), "a", wrap[len(wrap)-1], wrap[0]), []bool{true, false, true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDedupWindow()
+			var got []bool
+			for _, p := range tt.in {
+				got = append(got, d.first([]byte(p)))
+			}
+			got = got[len(got)-len(tt.first):]
+			for i := range got {
+				if got[i] != tt.first[i] {
+					t.Fatalf("first = %v, want %v", got, tt.first)
+				}
+			}
+		})
+	}
+}
+
+// openTestMultipath opens one half of a multipath session over relays.
+func openTestMultipath(ctx context.Context, t *testing.T, relays []*testRelay) *relayMultipath {
+	t.Helper()
+	keys := make(map[string]string)
+	a := NewApp("key", "", AppTypeServer, Options{LogOutput: io.Discard, Transport: TransportUDP, RelayKeys: keys})
+	for _, r := range relays {
+		a.relays = append(a.relays, r.addr().String())
+		keys[r.addr().String()] = r.publicKey()
+	}
+	m, err := a.openMultipath(ctx, "mosh-key", make(chan []byte), make(chan []byte))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.stop() })
+	return m
+}
+
+func TestMultipathRoundTrip(t *testing.T) {
+	relays := []*testRelay{startTestRelay(t, "udp", "127.0.0.1:0"), startTestRelay(t, "udp", "127.0.0.1:0")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, server := openTestMultipath(ctx, t, relays), openTestMultipath(ctx, t, relays)
+	go client.serve(ctx)
+	go server.serve(ctx)
+	for i := 0; i < 10; i++ {
+		up := "up " + strconv.Itoa(i)
+		client.receiver <- []byte(up)
+		if got := receive(t, server.sender); got != up {
+			t.Fatalf("server got %q, want %q", got, up)
+		}
+	}
+	select {
+	case p := <-server.sender:
+		t.Fatalf("server got %q twice", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMultipathFailsOverToUnusedRelay(t *testing.T) {
+	relays := []*testRelay{
+		startTestRelay(t, "udp", "127.0.0.1:0"),
+		startTestRelay(t, "udp", "127.0.0.1:0"),
+		startTestRelay(t, "udp", "127.0.0.1:0"),
+	}
+	m := openTestMultipath(context.Background(), t, relays)
+	if got, want := m.current(), relays[0].addr().String()+","+relays[1].addr().String(); got != want {
+		t.Fatalf("paths on %s, want %s", got, want)
+	}
+
+	// The first path fails over past the relay the second one is on, and
+	// back to its own relay once no other is left.
+	first := m.paths[0].failover
+	for _, want := range []*testRelay{relays[2], relays[0]} {
+		first.stop()
+		if err := first.open(context.Background(), first.index+1); err != nil {
+			t.Fatal(err)
+		}
+		if got := first.current(); got != want.addr().String() {
+			t.Fatalf("failed over to %s, want %s", got, want.addr())
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package mosh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	loopbackOnce sync.Once
+	loopback     net.IP
+)
+
+// loopbackIP returns the address local servers are reached on, the IPv4
+// loopback address unless the host has no IPv4, as in IPv6-only containers.
+func loopbackIP() net.IP {
+	loopbackOnce.Do(func() {
+		loopback = net.IPv4(127, 0, 0, 1)
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+		if err != nil {
+			loopback = net.IPv6loopback
+			return
+		}
+		conn.Close()
+	})
+	return loopback
+}
+
+// loopbackFor returns the loopback address of the same family as ip, or
+// loopbackIP when ip is nil.
+func loopbackFor(ip net.IP) net.IP {
+	switch {
+	case ip == nil:
+		return loopbackIP()
+	case ip.To4() == nil:
+		return net.IPv6loopback
+	default:
+		return net.IPv4(127, 0, 0, 1)
+	}
+}
+
+// happyEyeballsDelay is how long a connection attempt gets before the next
+// address is tried alongside it, as recommended by RFC 8305.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// resolveUDPAddrs returns every address of host:port, alternating between
+// IPv6 and IPv4 starting with IPv6.
+func resolveUDPAddrs(ctx context.Context, addr string) ([]*net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %w", err)
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", service)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	var v6, v4 []*net.UDPAddr
+	for _, ip := range ips {
+		udpAddr := &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+		if ip.IP.To4() != nil {
+			v4 = append(v4, udpAddr)
+		} else {
+			v6 = append(v6, udpAddr)
+		}
+	}
+	var addrs []*net.UDPAddr
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			addrs, v6 = append(addrs, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			addrs, v4 = append(addrs, v4[0]), v4[1:]
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	return addrs, nil
+}
+
+// dialHappyEyeballs runs attempt against the addresses of addr, see
+// resolveUDPAddrs, and returns the first client that opens. The next address
+// is tried as soon as the previous attempt fails or after
+// happyEyeballsDelay, so a dual-stack relay whose IPv6 path is broken costs
+// a fraction of a second. Clients opened by losing attempts are stopped.
+func dialHappyEyeballs(
+	ctx context.Context, addr string, attempt func(context.Context, *net.UDPAddr) (relayClient, error),
+) (relayClient, error) {
+	addrs, err := resolveUDPAddrs(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 1 {
+		return attempt(ctx, addrs[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		client relayClient
+		err    error
+	}
+	results := make(chan result, len(addrs))
+	start := func(a *net.UDPAddr) {
+		go func() {
+			c, err := attempt(ctx, a)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", a, err)
+			}
+			results <- result{c, err}
+		}()
+	}
+
+	start(addrs[0])
+	next, pending := 1, 1
+	delay := time.After(happyEyeballsDelay)
+	var errs []error
+	for {
+		select {
+		case <-delay:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.err == nil {
+							r.client.stop()
+						}
+					}
+				}(pending)
+				return r.client, nil
+			}
+			errs = append(errs, r.err)
+			if next == len(addrs) && pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		}
+		if next < len(addrs) {
+			start(addrs[next])
+			next, pending = next+1, pending+1
+			delay = time.After(happyEyeballsDelay)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package mosh
+
+import "net"
+
+// peerPID returns 0, the peer of a unix socket cannot be told here.
+func peerPID(conn net.Conn) int {
+	return 0
+}
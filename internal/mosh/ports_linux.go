@@ -0,0 +1,79 @@
+//go:build linux
+
+package mosh
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ownsUDPPort reports whether process pid holds a UDP socket bound to port,
+// or any UDP socket when port is 0. Unlike checking that pid exists, this
+// cannot be fooled by the PID being reused or by another process taking
+// the port.
+func ownsUDPPort(pid, port int) bool {
+	if pid <= 0 {
+		return false
+	}
+	inodes := socketInodes(pid)
+	if len(inodes) == 0 {
+		return false
+	}
+	for _, table := range []string{"udp", "udp6"} {
+		if udpTableHas(fmt.Sprintf("/proc/%d/net/%s", pid, table), port, inodes) {
+			return true
+		}
+	}
+	return false
+}
+
+// socketInodes returns the inodes of the sockets pid has open.
+func socketInodes(pid int) map[string]bool {
+	dir := fmt.Sprintf("/proc/%d/fd", pid)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	inodes := make(map[string]bool)
+	for _, e := range entries {
+		link, err := os.Readlink(dir + "/" + e.Name())
+		if err != nil {
+			continue
+		}
+		if inode, ok := strings.CutPrefix(link, "socket:["); ok {
+			inodes[strings.TrimSuffix(inode, "]")] = true
+		}
+	}
+	return inodes
+}
+
+// udpTableHas reports whether the /proc/net/udp style table at path lists
+// a socket bound to port, or to any port when it is 0, among inodes.
+func udpTableHas(path string, port int, inodes map[string]bool) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || !inodes[fields[9]] {
+			continue
+		}
+		_, hexPort, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		if p, err := strconv.ParseUint(hexPort, 16, 16); err == nil && (port == 0 || int(p) == port) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package mosh
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// ownsUDPPort reports whether process pid holds a UDP socket bound to port,
+// or any UDP socket when port is 0. It asks lsof, and reports false where
+// lsof is not available.
+func ownsUDPPort(pid, port int) bool {
+	if pid <= 0 {
+		return false
+	}
+	udp := "-iUDP"
+	if port != 0 {
+		udp += ":" + strconv.Itoa(port)
+	}
+	out, err := exec.Command("lsof", "-nP", "-t", "-a", "-p", strconv.Itoa(pid), udp).Output()
+	return err == nil && len(out) > 0
+}
@@ -0,0 +1,40 @@
+package mosh
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+func TestOwnsUDPPort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		if _, err := exec.LookPath("lsof"); err != nil {
+			t.Skip("lsof is not available")
+		}
+	}
+	conn := listenLoopback(t)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	other := listenLoopback(t)
+	otherPort := other.LocalAddr().(*net.UDPAddr).Port
+	other.Close()
+
+	for _, tt := range []struct {
+		name      string
+		pid, port int
+		want      bool
+	}{
+		{"own port", os.Getpid(), port, true},
+		{"any port", os.Getpid(), 0, true},
+		{"released port", os.Getpid(), otherPort, false},
+		{"other process", os.Getppid(), port, false},
+		{"no process", 0, port, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ownsUDPPort(tt.pid, tt.port); got != tt.want {
+				t.Fatalf("ownsUDPPort(%d, %d) = %v, want %v", tt.pid, tt.port, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package mosh
+
+import (
+	"errors"
+	"os"
+)
+
+// terminate kills process pid, it cannot be asked to exit here.
+func terminate(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := p.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
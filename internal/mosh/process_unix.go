@@ -0,0 +1,21 @@
+//go:build unix
+
+package mosh
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// terminate asks process pid to exit.
+func terminate(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package mosh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// relayTimeout is how long a relay may leave the datagrams sent
+	// through it unanswered, once traffic has flowed through it, before the
+	// session fails over. mosh sends a heartbeat every few seconds, so
+	// silence means the relay or the path to it is gone.
+	relayTimeout = 15 * time.Second
+
+	// relayActive is how recently a datagram must have been sent through
+	// the relay for its silence to count. An idle relay, as while traffic
+	// flows directly, has not failed.
+	relayActive = 5 * time.Second
+
+	// failoverRetry is how long to wait before trying the relays again
+	// when none of them is available.
+	failoverRetry = 2 * time.Second
+)
+
+// errCredentialExpired is returned instead of failing over once the relay
+// credential expired, no relay would accept the session.
+var errCredentialExpired = errors.New("relay credential expired")
+
+// relayFailover keeps the session on the first relay, in the selected
+// order, that accepts it. When the current relay fails or stops forwarding
+// traffic, the relays are tried in the same order starting with the one
+// after it, wrapping around. Both halves walk the same list from the same
+// place, so they meet again on the same relay.
+type relayFailover struct {
+	app              *App
+	log              *logger
+	moshKey          string
+	sender, receiver chan []byte
+	inbound          chan []byte // datagrams from the current relay
+	outbound         chan []byte // datagrams for the current relay
+
+	// skip, when set, reports relays not to open, as those the other
+	// paths of a relayMultipath are on.
+	skip func(relay string) bool
+
+	mu         sync.Mutex
+	client     relayClient
+	relay      string
+	index      int       // of relay in the selected order
+	lastSeen   time.Time // zero until the current relay forwarded a datagram
+	lastSent   time.Time
+	unanswered time.Time // first datagram sent since the relay last forwarded one
+}
+
+// relaySession is the connection of one half to the relays.
+type relaySession interface {
+	relayClient
+	// current returns the relays in use.
+	current() string
+}
+
+// openRelays connects to the first available relay, or to the first two
+// when datagrams are duplicated across relays.
+func (a *App) openRelays(ctx context.Context, moshKey string, sender, receiver chan []byte) (relaySession, error) {
+	if a.opts.Multipath && len(a.relays) > 1 {
+		return a.openMultipath(ctx, moshKey, sender, receiver)
+	}
+	if a.opts.Multipath && !a.opts.PeerToPeer {
+		a.log.Warn("Multipath needs a second relay or --p2p, not duplicating datagrams")
+	}
+	return a.openFailover(ctx, moshKey, sender, receiver)
+}
+
+// openFailover connects to the first available relay.
+func (a *App) openFailover(ctx context.Context, moshKey string, sender, receiver chan []byte) (*relayFailover, error) {
+	f := a.newFailover(moshKey, sender, receiver)
+	if err := f.open(ctx, 0); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (a *App) newFailover(moshKey string, sender, receiver chan []byte) *relayFailover {
+	return &relayFailover{
+		app:      a,
+		log:      a.log.with("failover"),
+		moshKey:  moshKey,
+		sender:   sender,
+		receiver: receiver,
+		inbound:  make(chan []byte),
+		outbound: make(chan []byte),
+	}
+}
+
+// open connects to the first available relay from the one at start on.
+func (f *relayFailover) open(ctx context.Context, start int) error {
+	if err := f.app.credentialExpired(); err != nil {
+		return err
+	}
+	relays := f.app.relays
+	var errs []error
+	for i := range relays {
+		index := (start + i) % len(relays)
+		relay := relays[index]
+		if f.skip != nil && f.skip(relay) {
+			continue
+		}
+		c, err := f.app.openRelay(ctx, relay, f.moshKey, f.inbound, f.outbound)
+		if err != nil {
+			f.log.Warn("Relay unavailable", "relay", relay, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.client, f.relay, f.index = c, relay, index
+		f.lastSeen, f.unanswered = time.Time{}, time.Time{}
+		return nil
+	}
+	return fmt.Errorf("no relay available: %w", errors.Join(errs...))
+}
+
+// credentialExpired returns errCredentialExpired once the API key's
+// expiry has passed.
+func (a *App) credentialExpired() error {
+	expiry := a.opts.CredentialExpiry
+	if expiry.IsZero() || time.Now().Before(expiry) {
+		return nil
+	}
+	return fmt.Errorf("%w at %s, run gh mosh resume to reconnect with a new one",
+		errCredentialExpired, expiry.Local().Format(time.DateTime))
+}
+
+// current returns the relay the session is on.
+func (f *relayFailover) current() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.relay
+}
+
+func (f *relayFailover) serve(ctx context.Context) error {
+	go f.forward(ctx)
+	go f.send(ctx)
+	for {
+		err := f.serveRelay(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		f.log.Warn("Relay failed, failing over", "relay", f.current(), "err", err)
+		if err := f.stop(); err != nil {
+			f.log.Debug("Failed to close relay", "err", err)
+		}
+		f.mu.Lock()
+		next := f.index + 1
+		f.mu.Unlock()
+		for {
+			err := f.open(ctx, next)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, errCredentialExpired) {
+				return err
+			}
+			f.log.Warn("Failed to fail over, retrying", "err", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(failoverRetry):
+			}
+		}
+		f.log.Info("Failed over", "relay", f.current())
+	}
+}
+
+// serveRelay serves the current relay until it fails or goes silent.
+func (f *relayFailover) serveRelay(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	f.mu.Lock()
+	client := f.client
+	f.mu.Unlock()
+
+	errs := make(chan error, 2)
+	go func() {
+		if err := client.serve(ctx); err != nil {
+			errs <- err
+		}
+	}()
+
+	go func() {
+		errs <- f.watch(ctx)
+	}()
+
+	return await(ctx, errs)
+}
+
+// watch returns an error once the current relay has left the datagrams
+// still being sent through it unanswered for relayTimeout.
+func (f *relayFailover) watch(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			f.mu.Lock()
+			silent := !f.lastSeen.IsZero() && !f.unanswered.IsZero() &&
+				time.Since(f.unanswered) > relayTimeout && time.Since(f.lastSent) < relayActive
+			f.mu.Unlock()
+			if silent {
+				return fmt.Errorf("no traffic for %s", relayTimeout)
+			}
+		}
+	}
+}
+
+// forward passes datagrams from whichever relay is current to sender.
+func (f *relayFailover) forward(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-f.inbound:
+			f.mu.Lock()
+			f.lastSeen, f.unanswered = time.Now(), time.Time{}
+			f.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case f.sender <- p:
+			}
+		}
+	}
+}
+
+// send passes datagrams from receiver to whichever relay is current.
+func (f *relayFailover) send(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-f.receiver:
+			f.mu.Lock()
+			f.lastSent = time.Now()
+			if f.unanswered.IsZero() {
+				f.unanswered = f.lastSent
+			}
+			f.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case f.outbound <- p:
+			}
+		}
+	}
+}
+
+func (f *relayFailover) stop() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.client == nil {
+		return nil
+	}
+	err := f.client.stop()
+	f.client = nil
+	return err
+}
@@ -0,0 +1,96 @@
+package mosh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deadRelay returns the address of a UDP port nothing answers on.
+func deadRelay(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func TestFailoverStartsAfterCurrentRelay(t *testing.T) {
+	relays := []*testRelay{
+		startTestRelay(t, "udp", "127.0.0.1:0"),
+		startTestRelay(t, "udp", "127.0.0.1:0"),
+	}
+	keys := make(map[string]string)
+	a := NewApp("key", "", AppTypeServer, Options{LogOutput: io.Discard, Transport: TransportUDP, RelayKeys: keys})
+	a.relays = []string{deadRelay(t)}
+	for _, r := range relays {
+		a.relays = append(a.relays, r.addr().String())
+		keys[r.addr().String()] = r.publicKey()
+	}
+	keys[a.relays[0]] = relays[0].publicKey()
+
+	f, err := a.openFailover(context.Background(), "mosh-key", make(chan []byte), make(chan []byte))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.stop()
+	if f.current() != a.relays[1] {
+		t.Fatalf("opened %s, want the first live relay %s", f.current(), a.relays[1])
+	}
+
+	// Failing over from the last relay wraps around, past the dead one.
+	for _, want := range []string{a.relays[2], a.relays[1]} {
+		f.stop()
+		if err := f.open(context.Background(), f.index+1); err != nil {
+			t.Fatal(err)
+		}
+		if f.current() != want {
+			t.Fatalf("failed over to %s, want %s", f.current(), want)
+		}
+	}
+}
+
+func TestSelectRelaysPingsInsecureRelays(t *testing.T) {
+	live := startTestRelay(t, "udp", "127.0.0.1:0")
+	a := NewApp("key", "", AppTypeClient, Options{LogOutput: io.Discard, Transport: TransportUDP, InsecureRelay: true})
+	a.relays = []string{deadRelay(t), live.addr().String()}
+
+	keys, err := a.selectRelays(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != nil {
+		t.Fatalf("returned keys %v for unverified relays", keys)
+	}
+	if a.relays[0] != live.addr().String() {
+		t.Fatalf("selected %v, want the relay answering first", a.relays)
+	}
+}
+
+func TestFailoverCredentialExpired(t *testing.T) {
+	relay := startTestRelay(t, "udp", "127.0.0.1:0")
+	a := NewApp("key", "", AppTypeServer, Options{
+		LogOutput: io.Discard, Transport: TransportUDP, InsecureRelay: true,
+		CredentialExpiry: time.Now().Add(-time.Minute),
+	})
+	a.relays = []string{relay.addr().String()}
+
+	_, err := a.openFailover(context.Background(), "mosh-key", make(chan []byte), make(chan []byte))
+	if !errors.Is(err, errCredentialExpired) || !strings.Contains(err.Error(), "gh mosh resume") {
+		t.Fatalf("openFailover = %v, want the credential to have expired", err)
+	}
+
+	a.opts.CredentialExpiry = time.Now().Add(time.Hour)
+	f, err := a.openFailover(context.Background(), "mosh-key", make(chan []byte), make(chan []byte))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.stop()
+}
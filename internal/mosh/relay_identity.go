@@ -0,0 +1,325 @@
+package mosh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/josebalius/gh-mosh/internal/config"
+)
+
+// HELLO proves the relay's identity and agrees on a key sealing CONNECT, so
+// the credential in it can only be read by that relay. The client sends
+// "HELLO <nonce> <client share>" and the relay answers
+// "HELLO <public key> <signature> <relay share>", signing helloContext
+// followed by the raw nonce and both shares with its ed25519 key. Shares are
+// X25519 public keys. CONNECT is then sent as
+// "CONNECT-SEALED <client share> <sealed>", sealed being a random nonce
+// followed by "CONNECT <credential> <mosh key>" encrypted with AES-256-GCM
+// under the key sealKey derives from both shares. Keys, shares, signatures
+// and sealed payloads are standard base64.
+const (
+	helloCommand  = "HELLO "
+	helloContext  = "gh-mosh relay hello "
+	sealedCommand = "CONNECT-SEALED "
+)
+
+// legacyRelayKey stands in for the key of a relay predating HELLO in the
+// keys the client hands the server half, see relayVerifier.allowLegacy.
+const legacyRelayKey = "legacy"
+
+// relayVerifier checks that the relay holds the expected ed25519 key. The
+// key is either pinned or, failing that, trusted on first use and recorded
+// in the known relays file.
+type relayVerifier struct {
+	log      *logger
+	relay    string            // name the relay is recorded under
+	pinned   ed25519.PublicKey // expected key, nil to trust on first use
+	path     string            // known relays file, empty to not record keys
+	insecure bool              // skip verification altogether
+	ping     bool              // when insecure, still wait for an unchecked HELLO reply
+
+	// allowLegacy accepts a relay that does not answer HELLO, as relays
+	// predating it, if no key is pinned or recorded for it. CONNECT then
+	// goes out unsealed. It is only set for relays the user listed in
+	// Options.LegacyRelays.
+	allowLegacy bool
+	legacy      bool // pinned to legacyRelayKey
+}
+
+// newRelayVerifier returns a verifier for relay. pinned is a base64 public
+// key, legacyRelayKey or empty.
+func newRelayVerifier(log *logger, relay, pinned string, record, insecure bool) (*relayVerifier, error) {
+	v := &relayVerifier{log: log, relay: relay, insecure: insecure}
+	switch pinned {
+	case "":
+	case legacyRelayKey:
+		v.legacy = true
+	default:
+		key, err := parseRelayKey(pinned)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pinned relay key: %w", err)
+		}
+		v.pinned = key
+	}
+	if record {
+		dir, err := config.Dir()
+		if err != nil {
+			return nil, err
+		}
+		v.path = filepath.Join(dir, "known_relays")
+	}
+	return v, nil
+}
+
+// expected returns the key the relay must present, if one is known before
+// connecting.
+func (v *relayVerifier) expected() (ed25519.PublicKey, error) {
+	if v.pinned != nil || v.path == "" {
+		return v.pinned, nil
+	}
+	known, err := readKnownRelays(v.path)
+	if err != nil {
+		return nil, err
+	}
+	return known[v.relay], nil
+}
+
+// relaySeal seals CONNECT with the key agreed on during HELLO. A nil seal,
+// for a relay whose identity was not verified, leaves CONNECT in the clear.
+type relaySeal struct {
+	share []byte // the client's X25519 public key
+	aead  cipher.AEAD
+}
+
+// connectCommand returns CONNECT for credential and moshKey, sealed when
+// seal is not nil.
+func connectCommand(seal *relaySeal, credential, moshKey string) ([]byte, error) {
+	connect := fmt.Sprintf("CONNECT %s %s", credential, moshKey)
+	if seal == nil {
+		return []byte(connect), nil
+	}
+	nonce := make([]byte, seal.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := seal.aead.Seal(nonce, nonce, []byte(connect), nil)
+	return []byte(sealedCommand + base64.StdEncoding.EncodeToString(seal.share) + " " +
+		base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// sealKey returns the AEAD sealing CONNECT for the X25519 secret agreed on
+// with the client's and the relay's shares.
+func sealKey(secret, clientShare, relayShare []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte("gh-mosh connect "))
+	h.Write(secret)
+	h.Write(clientShare)
+	h.Write(relayShare)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// helloSigned returns what the relay signs in its HELLO reply.
+func helloSigned(nonce, clientShare, relayShare []byte) []byte {
+	signed := append([]byte(helloContext), nonce...)
+	signed = append(signed, clientShare...)
+	return append(signed, relayShare...)
+}
+
+// verify sends a HELLO through exchange, which must return the relay's
+// HELLO reply, checks the signed response and returns the seal for CONNECT.
+func (v *relayVerifier) verify(ctx context.Context, exchange func(context.Context, []byte) ([]byte, error)) (*relaySeal, error) {
+	if v.insecure && !v.ping {
+		v.log.Warn("Not verifying the relay's identity", "relay", v.relay)
+		return nil, nil
+	}
+	if v.legacy {
+		v.log.Warn("Not verifying the relay's identity, the client accepted it as predating HELLO", "relay", v.relay)
+		return nil, nil
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key share: %w", err)
+	}
+	share := priv.PublicKey().Bytes()
+	hello := helloCommand + hex.EncodeToString(nonce) + " " + base64.StdEncoding.EncodeToString(share)
+	reply, err := exchange(ctx, []byte(hello))
+	if v.insecure {
+		// Only the round trip is measured, the reply is not checked.
+		if err != nil {
+			return nil, fmt.Errorf("relay did not answer: %w", err)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		if v.allowLegacy {
+			if key, kerr := v.expected(); kerr == nil && key == nil {
+				v.log.Warn("Relay did not answer HELLO, using it unverified as a relay predating it", "relay", v.relay, "err", err)
+				return nil, nil
+			}
+		}
+		return nil, fmt.Errorf("relay did not prove its identity: %w", err)
+	}
+	fields := strings.Fields(strings.TrimPrefix(string(reply), helloCommand))
+	if len(fields) != 3 {
+		return nil, errors.New("relay sent a malformed hello")
+	}
+	key, err := parseRelayKey(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("relay sent an invalid key: %w", err)
+	}
+	relayShare, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, errors.New("relay sent an invalid key share")
+	}
+	sig, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil || !ed25519.Verify(key, helloSigned(nonce, share, relayShare), sig) {
+		return nil, errors.New("relay sent an invalid signature")
+	}
+	if err := v.trust(key); err != nil {
+		return nil, err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(relayShare)
+	if err != nil {
+		return nil, errors.New("relay sent an invalid key share")
+	}
+	secret, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to agree on a key: %w", err)
+	}
+	aead, err := sealKey(secret, share, relayShare)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive the connect key: %w", err)
+	}
+	v.log.Debug("Verified relay identity", "relay", v.relay, "key", relayKeyFingerprint(key))
+	return &relaySeal{share: share, aead: aead}, nil
+}
+
+func (v *relayVerifier) trust(key ed25519.PublicKey) error {
+	if v.pinned != nil {
+		if !key.Equal(v.pinned) {
+			return fmt.Errorf(
+				"relay key %s does not match the pinned key %s",
+				relayKeyFingerprint(key), relayKeyFingerprint(v.pinned),
+			)
+		}
+		return nil
+	}
+	if v.path == "" {
+		return nil
+	}
+	known, err := readKnownRelays(v.path)
+	if err != nil {
+		return err
+	}
+	if k, ok := known[v.relay]; ok {
+		if !key.Equal(k) {
+			return fmt.Errorf(
+				"relay key for %s changed from %s to %s, remove it from %s if this is expected",
+				v.relay, relayKeyFingerprint(k), relayKeyFingerprint(key), v.path,
+			)
+		}
+		return nil
+	}
+	v.log.Warn("Trusting relay key on first use", "relay", v.relay, "key", relayKeyFingerprint(key))
+	return appendKnownRelay(v.path, v.relay, key)
+}
+
+func parseRelayKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected %d bytes, got %d", ed25519.PublicKeySize, len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+func encodeRelayKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func relayKeyFingerprint(key ed25519.PublicKey) string {
+	return Fingerprint(string(key))
+}
+
+// readKnownRelays reads the known relays file, made of "<relay> <key>"
+// lines. A missing file has no relays.
+func readKnownRelays(path string) (map[string]ed25519.PublicKey, error) {
+	known := make(map[string]ed25519.PublicKey)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known relays: %w", err)
+	}
+	scan := bufio.NewScanner(bytes.NewReader(b))
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key, err := parseRelayKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for %s in %s: %w", fields[0], path, err)
+		}
+		known[fields[0]] = key
+	}
+	return known, nil
+}
+
+// appendKnownRelay records key for relay. Other gh-mosh processes may be
+// trusting the same relay, so the file is locked and read again first.
+func appendKnownRelay(path, relay string, key ed25519.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	lock, err := lockFile(path+".lock", true)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	known, err := readKnownRelays(path)
+	if err != nil {
+		return err
+	}
+	if k, ok := known[relay]; ok {
+		if !key.Equal(k) {
+			return fmt.Errorf("relay key for %s was just recorded as %s, not %s", relay, relayKeyFingerprint(k), relayKeyFingerprint(key))
+		}
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known relays: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s\n", relay, encodeRelayKey(key)); err != nil {
+		return fmt.Errorf("failed to record relay key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package mosh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRelayConnectIsSealed(t *testing.T) {
+	relay := startTestRelay(t, "udp", "127.0.0.1:0")
+	v, err := newRelayVerifier(testLogger(), "relay", relay.publicKey(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newRelayServerClient(testLogger(), "ghm1.secret-credential", "mosh-key", relay.addr(), false, nil, nil)
+	defer c.stop()
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	if err := c.open(ctx, v, true); err != nil {
+		t.Fatal(err)
+	}
+
+	connects := relay.received()
+	if len(connects) != 1 {
+		t.Fatalf("relay got %d connects, want 1", len(connects))
+	}
+	if !strings.HasPrefix(connects[0], sealedCommand) || strings.Contains(connects[0], "secret-credential") {
+		t.Fatalf("connect was sent in the clear: %q", connects[0])
+	}
+	connect, err := relay.open([]byte(connects[0]))
+	if err != nil || connect != "CONNECT ghm1.secret-credential mosh-key" {
+		t.Fatalf("relay opened %q, %v", connect, err)
+	}
+}
+
+func TestRelayVerifierRejectsSubstitutedShare(t *testing.T) {
+	relay := startTestRelay(t, "udp", "127.0.0.1:0")
+	v, err := newRelayVerifier(testLogger(), "relay", relay.publicKey(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A man in the middle passes HELLO on to the relay, keeping its
+	// signature but putting its own share in the reply.
+	mitm := func(ctx context.Context, p []byte) ([]byte, error) {
+		reply, err := relay.hello(p)
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(string(reply))
+		own := make([]byte, 32)
+		rand.Read(own)
+		fields[3] = base64.StdEncoding.EncodeToString(own)
+		return []byte(strings.Join(fields, " ")), nil
+	}
+	if _, err := v.verify(context.Background(), mitm); err == nil {
+		t.Fatal("accepted a substituted key share")
+	}
+	if _, err := v.verify(context.Background(), func(ctx context.Context, p []byte) ([]byte, error) {
+		return relay.hello(p)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayVerifierLegacy(t *testing.T) {
+	noHello := func(ctx context.Context, p []byte) ([]byte, error) {
+		return nil, context.DeadlineExceeded
+	}
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	pinned := encodeRelayKey(pub)
+
+	for _, tt := range []struct {
+		name        string
+		pinned      string
+		allowLegacy bool
+		ok          bool
+	}{
+		{"not allowed", "", false, false},
+		{"unknown relay", "", true, true},
+		{"pinned relay", pinned, true, false},
+		{"accepted by the client", legacyRelayKey, false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newRelayVerifier(testLogger(), "relay", tt.pinned, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.allowLegacy = tt.allowLegacy
+			seal, err := v.verify(context.Background(), noHello)
+			if (err == nil) != tt.ok {
+				t.Fatalf("verify = %v, want ok %v", err, tt.ok)
+			}
+			if seal != nil {
+				t.Fatal("sealed CONNECT for an unverified relay")
+			}
+		})
+	}
+}
+
+func TestAppendKnownRelayConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_relays")
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	key := priv.Public().(ed25519.PublicKey)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- appendKnownRelay(path, "relay.example.com:9000", key)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 1 {
+		t.Fatalf("recorded the relay %d times:\n%s", lines, b)
+	}
+
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	if err := appendKnownRelay(path, "relay.example.com:9000", other.Public().(ed25519.PublicKey)); err == nil {
+		t.Fatal("recorded a second key for the relay")
+	}
+}
@@ -0,0 +1,167 @@
+package mosh
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN is the application protocol negotiated with the relay.
+const quicALPN = "gh-mosh-relay"
+
+// relayQUICClient sends mosh datagrams to the relay as QUIC unreliable
+// datagrams (RFC 9221). TLS authenticates the relay, while the datagrams
+// stay unreliable so mosh's SSP retransmission and prediction keep working
+// as over plain UDP. A change of local network ends the connection, and
+// relayFailover opens a new one.
+type relayQUICClient struct {
+	log              *logger
+	sender, receiver chan []byte
+	apiKey, moshKey  string
+	addr             string         // host:port, the host is the TLS server name
+	remoteAddr       *net.UDPAddr   // resolved address dialed
+	roots            *x509.CertPool // trusted for TLS, the system's when nil
+
+	conn quic.Connection
+}
+
+func newRelayQUICClient(
+	log *logger, apiKey, moshKey, addr string, remoteAddr *net.UDPAddr, sender, receiver chan []byte,
+) *relayQUICClient {
+	return &relayQUICClient{
+		log:        log,
+		apiKey:     apiKey,
+		moshKey:    moshKey,
+		addr:       addr,
+		remoteAddr: remoteAddr,
+		sender:     sender,
+		receiver:   receiver,
+	}
+}
+
+// open dials the relay, verifies its identity, sends CONNECT and waits for
+// the acknowledgement, retransmitting requests as datagrams may be lost.
+// Without a mosh key the relay is only identified.
+func (r *relayQUICClient) open(ctx context.Context, v *relayVerifier) error {
+	host, _, err := net.SplitHostPort(r.addr)
+	if err != nil {
+		return fmt.Errorf("invalid relay address: %w", err)
+	}
+	tlsConf := &tls.Config{ServerName: host, RootCAs: r.roots, NextProtos: []string{quicALPN}, MinVersion: tls.VersionTLS13}
+	conn, err := quic.DialAddr(ctx, r.remoteAddr.String(), tlsConf, &quic.Config{
+		EnableDatagrams: true,
+		KeepAlivePeriod: 15 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dial quic: %w", err)
+	}
+	r.conn = conn
+	if !conn.ConnectionState().SupportsDatagrams {
+		return errors.New("relay does not support quic datagrams")
+	}
+
+	seal, err := v.verify(ctx, r.hello)
+	if err != nil {
+		return err
+	}
+	if r.moshKey == "" {
+		return nil
+	}
+	connect, err := connectCommand(seal, r.apiKey, r.moshKey)
+	if err != nil {
+		return err
+	}
+	isAck := func(p []byte) bool { return string(p) == connectedReply }
+	if _, err := r.request(ctx, connect, isAck); err != nil {
+		return fmt.Errorf("relay did not acknowledge connect: %w", err)
+	}
+	r.log.Debug("Relay acknowledged connect", "relay", r.addr, "transport", TransportQUIC)
+	return nil
+}
+
+func (r *relayQUICClient) hello(ctx context.Context, p []byte) ([]byte, error) {
+	return r.request(ctx, p, func(reply []byte) bool { return bytes.HasPrefix(reply, []byte(helloCommand)) })
+}
+
+// request sends p as a datagram, retransmitting it until the relay answers
+// with a datagram matching isReply or ctx is done.
+func (r *relayQUICClient) request(ctx context.Context, p []byte, isReply func([]byte) bool) ([]byte, error) {
+	for {
+		if err := r.conn.SendDatagram(p); err != nil {
+			return nil, fmt.Errorf("failed to send datagram: %w", err)
+		}
+		retryCtx, cancel := context.WithTimeout(ctx, handshakeRetry)
+		reply, err := r.conn.ReceiveDatagram(retryCtx)
+		cancel()
+		if err == nil && isReply(reply) {
+			return reply, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *relayQUICClient) serve(ctx context.Context) error {
+	errs := make(chan error, 2)
+	go func() {
+		if err := r.read(ctx); err != nil {
+			errs <- fmt.Errorf("failed to read: %w", err)
+		}
+	}()
+
+	go func() {
+		if err := r.write(ctx); err != nil {
+			errs <- fmt.Errorf("failed to write: %w", err)
+		}
+	}()
+
+	return await(ctx, errs)
+}
+
+func (r *relayQUICClient) stop() error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.CloseWithError(0, "")
+}
+
+func (r *relayQUICClient) read(ctx context.Context) error {
+	for {
+		p, err := r.conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to receive datagram: %w", err)
+		}
+		if string(p) == connectedReply || bytes.HasPrefix(p, []byte(helloCommand)) {
+			continue // late reply to a retransmitted handshake
+		}
+		r.sender <- p
+	}
+}
+
+func (r *relayQUICClient) write(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case p := <-r.receiver:
+			err := r.conn.SendDatagram(p)
+			var tooLarge *quic.DatagramTooLargeError
+			if errors.As(err, &tooLarge) {
+				// Like an oversized UDP packet, drop it and let mosh resend.
+				r.log.Debug("Dropping datagram too large for quic", "size", len(p), "max", tooLarge.MaxDatagramPayloadSize)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to send datagram: %w", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package mosh
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+// testQUICRelay is the QUIC side of testRelay: it speaks the same protocol
+// in datagrams, refusing CONNECTs that are not sealed, and forwards
+// datagrams between the two connections that connected with the same mosh
+// key.
+type testQUICRelay struct {
+	relay *testRelay // answers HELLO and opens sealed CONNECTs
+	ln    *quic.Listener
+
+	mu    sync.Mutex
+	pairs map[string][]quic.Connection
+}
+
+func startTestQUICRelay(t *testing.T, config *tls.Config) *testQUICRelay {
+	t.Helper()
+	config = config.Clone()
+	config.NextProtos = []string{quicALPN}
+	ln, err := quic.ListenAddr("127.0.0.1:0", config, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Skipf("cannot listen for quic: %v", err)
+	}
+	r := &testQUICRelay{relay: startTestRelay(t, "udp", "127.0.0.1:0"), ln: ln, pairs: make(map[string][]quic.Connection)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *testQUICRelay) serve(conn quic.Connection) {
+	for {
+		p, err := conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		switch {
+		case bytes.HasPrefix(p, []byte(helloCommand)):
+			if reply, err := r.relay.hello(p); err == nil {
+				conn.SendDatagram(reply)
+			}
+		case bytes.HasPrefix(p, []byte(sealedCommand)):
+			connect, err := r.relay.open(p)
+			fields := strings.Fields(connect)
+			if err != nil || len(fields) != 3 {
+				continue
+			}
+			r.mu.Lock()
+			if !containsConn(r.pairs[fields[2]], conn) { // retransmitted
+				r.pairs[fields[2]] = append(r.pairs[fields[2]], conn)
+			}
+			r.mu.Unlock()
+			conn.SendDatagram([]byte(connectedReply))
+		default:
+			if peer := r.peer(conn); peer != nil {
+				peer.SendDatagram(p)
+			}
+		}
+	}
+}
+
+func containsConn(conns []quic.Connection, conn quic.Connection) bool {
+	for _, c := range conns {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *testQUICRelay) peer(conn quic.Connection) quic.Connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, conns := range r.pairs {
+		if len(conns) != 2 {
+			continue
+		}
+		switch conn {
+		case conns[0]:
+			return conns[1]
+		case conns[1]:
+			return conns[0]
+		}
+	}
+	return nil
+}
+
+// TestRelayQUICRoundTrip pairs both halves through a QUIC relay, which
+// verifies HELLO and the sealed CONNECT, and passes datagrams both ways.
+func TestRelayQUICRoundTrip(t *testing.T) {
+	config, roots := selfSignedTLS(t)
+	relay := startTestQUICRelay(t, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr := relay.ln.Addr().String()
+	open := func(publicKey string) (*relayQUICClient, error) {
+		v, err := newRelayVerifier(testLogger(), addr, publicKey, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := newRelayQUICClient(testLogger(), "key", "mosh-key", addr, relay.ln.Addr().(*net.UDPAddr), make(chan []byte), make(chan []byte))
+		c.roots = roots
+		t.Cleanup(func() { c.stop() })
+		openCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+		defer cancel()
+		return c, c.open(openCtx, v)
+	}
+
+	// A relay presenting another key is refused before CONNECT.
+	other := startTestRelay(t, "udp", "127.0.0.1:0")
+	if _, err := open(other.publicKey()); err == nil {
+		t.Fatal("opened a relay presenting the wrong key")
+	}
+
+	var halves []*relayQUICClient
+	for i := 0; i < 2; i++ {
+		c, err := open(relay.relay.publicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go c.serve(ctx)
+		halves = append(halves, c)
+	}
+	client, server := halves[0], halves[1]
+	for i := 0; i < 20; i++ {
+		client.receiver <- []byte("up")
+		if got := receive(t, server.sender); got != "up" {
+			t.Fatalf("server got %q", got)
+		}
+		server.receiver <- []byte("down")
+		if got := receive(t, client.sender); got != "down" {
+			t.Fatalf("client got %q", got)
+		}
+	}
+}
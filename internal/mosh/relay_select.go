@@ -0,0 +1,125 @@
+package mosh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srvPrefix marks a relay list entry naming a domain whose
+// _gh-mosh._udp SRV records list the relays.
+const srvPrefix = "srv:"
+
+// resolveRelays expands a comma-separated relay list, looking up SRV
+// entries, into relay addresses in the order given. SRV records keep the
+// order the resolver returns them in, by priority and weight.
+func resolveRelays(ctx context.Context, spec string) ([]string, error) {
+	var relays []string
+	seen := make(map[string]bool)
+	add := func(relay string) {
+		if !seen[relay] {
+			seen[relay] = true
+			relays = append(relays, relay)
+		}
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.HasPrefix(entry, srvPrefix) {
+			add(entry)
+			continue
+		}
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "gh-mosh", "udp", strings.TrimPrefix(entry, srvPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up relays: %w", err)
+		}
+		for _, srv := range records {
+			add(net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+		}
+	}
+	if len(relays) == 0 {
+		return nil, fmt.Errorf("no relays in %q", spec)
+	}
+	return relays, nil
+}
+
+// selectRelays orders the relays by round trip time, measured by how long
+// each takes to prove its identity, or only to answer HELLO when relays are
+// not verified. Relays that cannot be reached are kept at the end, in the
+// order given, as they may come back mid-session. The server half is handed
+// the resulting order so both halves fail over the same way. It returns the
+// key verified for each relay.
+func (a *App) selectRelays(ctx context.Context) (map[string]string, error) {
+	rtts := make(map[string]time.Duration)
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, relay := range a.relays {
+		wg.Add(1)
+		go func(relay string) {
+			defer wg.Done()
+			start := time.Now()
+			c, err := a.openRelay(ctx, relay, "", nil, nil)
+			if err != nil {
+				a.log.Warn("Relay unavailable", "relay", relay, "err", err)
+				return
+			}
+			rtt := time.Since(start)
+			c.stop()
+			a.log.Debug("Probed relay", "relay", relay, "rtt", rtt)
+			mu.Lock()
+			defer mu.Unlock()
+			rtts[relay] = rtt
+		}(relay)
+	}
+	wg.Wait()
+	if len(rtts) == 0 && a.opts.InsecureRelay {
+		// Relays predating HELLO never answer it.
+		a.log.Warn("No relay answered, keeping the order given", "relays", strings.Join(a.relays, ","))
+		return nil, nil
+	}
+	if len(rtts) == 0 {
+		return nil, fmt.Errorf("no relay could be reached")
+	}
+
+	sort.SliceStable(a.relays, func(i, j int) bool {
+		ri, iok := rtts[a.relays[i]]
+		rj, jok := rtts[a.relays[j]]
+		if iok != jok {
+			return iok
+		}
+		return iok && ri < rj
+	})
+
+	a.log.Info("Selected relay", "relay", a.relays[0], "rtt", rtts[a.relays[0]].Round(time.Millisecond))
+	if a.opts.InsecureRelay {
+		return nil, nil
+	}
+	keys := make(map[string]string)
+	for _, relay := range a.relays {
+		verifier, err := a.relayVerifier(a.log.with("relay"), relay)
+		if err != nil {
+			return nil, err
+		}
+		key, err := verifier.expected()
+		if err != nil {
+			return nil, err
+		}
+		switch _, reached := rtts[relay]; {
+		case key != nil:
+			keys[relay] = encodeRelayKey(key)
+		case reached:
+			// Reached without a key, it predates HELLO.
+			keys[relay] = legacyRelayKey
+		}
+	}
+	return keys, nil
+}
@@ -1,42 +1,120 @@
 package mosh
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 )
 
 type relayServerClient struct {
+	log              *logger
 	sender, receiver chan []byte
 	apiKey, moshKey  string
 	remoteAddr       *net.UDPAddr
+	p2p              bool         // try to move traffic to a punched peer-to-peer path
+	dedup            *dedupWindow // set to keep sending through the relay alongside the peer
 
 	conn *net.UDPConn
+	seal *relaySeal
+
+	mu        sync.Mutex
+	candidate *net.UDPAddr // peer endpoint reported by the relay
+	peer      *net.UDPAddr // established peer-to-peer path, nil while relaying
+	peerSeen  time.Time
+	punches   map[string]time.Time // nonces of the punches awaiting an answer
+	peerLost  chan struct{}        // signalled when route drops a quiet peer
+	relaySent time.Time            // last datagram sent to the relay
 }
 
 func newRelayServerClient(
-	apiKey, moshKey string, remoteAddr *net.UDPAddr, sender, receiver chan []byte,
+	log *logger, apiKey, moshKey string, remoteAddr *net.UDPAddr, p2p bool, sender, receiver chan []byte,
 ) *relayServerClient {
 	return &relayServerClient{
+		log:        log,
 		apiKey:     apiKey,
 		sender:     sender,
 		receiver:   receiver,
 		moshKey:    moshKey,
 		remoteAddr: remoteAddr,
+		p2p:        p2p,
+		punches:    make(map[string]time.Time),
+		peerLost:   make(chan struct{}, 1),
 	}
 }
 
-func (r *relayServerClient) connect(ctx context.Context) error {
-	conn, err := net.DialUDP("udp", nil, r.remoteAddr)
+// open verifies the relay's identity and sends CONNECT. When waitAck is set
+// it retransmits CONNECT until the relay acknowledges it or ctx is done, so
+// callers can detect networks that drop UDP. Without a mosh key the relay is
+// only identified.
+func (r *relayServerClient) open(ctx context.Context, v *relayVerifier, waitAck bool) error {
+	// The socket is not connected to the relay so the same local port, and
+	// NAT mapping, can be used to reach a hole punched peer.
+	conn, err := net.ListenUDP("udp", nil)
 	if err != nil {
-		return fmt.Errorf("failed to dial udp: %w", err)
+		return fmt.Errorf("failed to listen udp: %w", err)
 	}
 	r.conn = conn
 
-	if err := r.sendConnect(ctx); err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
+	if r.seal, err = v.verify(ctx, r.hello); err != nil {
+		return err
+	}
+	if r.moshKey == "" {
+		return nil
+	}
+	if !waitAck {
+		if err := r.sendConnect(ctx); err != nil {
+			return fmt.Errorf("failed to connect: %w", err)
+		}
+		r.log.Debug("Sent connect", "relay", r.remoteAddr, "local", conn.LocalAddr())
+		return nil
+	}
+	connect, err := connectCommand(r.seal, r.apiKey, r.moshKey)
+	if err != nil {
+		return err
 	}
+	isAck := func(p []byte) bool { return string(p) == connectedReply }
+	if _, err := r.request(ctx, connect, isAck); err != nil {
+		return fmt.Errorf("relay did not acknowledge connect: %w", err)
+	}
+	r.log.Debug("Relay acknowledged connect", "relay", r.remoteAddr, "local", conn.LocalAddr())
+	return nil
+}
+
+func (r *relayServerClient) hello(ctx context.Context, p []byte) ([]byte, error) {
+	return r.request(ctx, p, func(reply []byte) bool { return bytes.HasPrefix(reply, []byte(helloCommand)) })
+}
 
+// request sends p to the relay, retransmitting it until the relay answers
+// with a datagram matching isReply or ctx is done.
+func (r *relayServerClient) request(ctx context.Context, p []byte, isReply func([]byte) bool) ([]byte, error) {
+	defer r.conn.SetReadDeadline(time.Time{})
+	reply := make([]byte, maxPacketSize)
+	for {
+		if _, err := r.conn.WriteToUDP(p, r.remoteAddr); err != nil {
+			return nil, fmt.Errorf("failed to write to udp: %w", err)
+		}
+		deadline := time.Now().Add(handshakeRetry)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := r.conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		n, from, err := r.conn.ReadFromUDP(reply)
+		if err == nil && sameAddr(from, r.remoteAddr) && isReply(reply[:n]) {
+			return reply[:n], nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// serve forwards datagrams between the relay and the local channels.
+func (r *relayServerClient) serve(ctx context.Context) error {
 	errs := make(chan error, 2)
 	go func() {
 		if err := r.read(ctx); err != nil {
@@ -50,25 +128,34 @@ func (r *relayServerClient) connect(ctx context.Context) error {
 		}
 	}()
 
+	if r.p2p {
+		go r.punchPeer(ctx)
+	}
+	if r.moshKey != "" {
+		go r.keepRelayAlive(ctx)
+	}
+
 	return await(ctx, errs)
 }
 
 func (r *relayServerClient) stop() error {
+	if r.conn == nil {
+		return nil
+	}
 	return r.conn.Close()
 }
 
 func (r *relayServerClient) sendConnect(ctx context.Context) error {
-	payload := []byte(connectCommand(r.apiKey, r.moshKey))
-	if _, err := r.conn.Write(payload); err != nil {
+	payload, err := connectCommand(r.seal, r.apiKey, r.moshKey)
+	if err != nil {
+		return err
+	}
+	if _, err := r.conn.WriteToUDP(payload, r.remoteAddr); err != nil {
 		return fmt.Errorf("failed to write to udp: %w", err)
 	}
 	return nil
 }
 
-func connectCommand(apiKey, moshKey string) string {
-	return fmt.Sprintf("CONNECT %s %s", apiKey, moshKey)
-}
-
 func (r *relayServerClient) read(ctx context.Context) error {
 	for {
 		select {
@@ -76,24 +163,68 @@ func (r *relayServerClient) read(ctx context.Context) error {
 			return ctx.Err()
 		default:
 			p := make([]byte, maxPacketSize)
-			n, _, err := r.conn.ReadFromUDP(p)
+			n, from, err := r.conn.ReadFromUDP(p)
 			if err != nil {
 				return fmt.Errorf("failed to read from udp: %w", err)
 			}
+			if !r.accept(from, p[:n]) {
+				continue
+			}
+			if r.dedup != nil && !r.dedup.first(p[:n]) {
+				continue
+			}
 			r.sender <- p[:n]
 		}
 	}
 }
 
+// accept handles rendezvous and hole punching packets and reports whether p
+// is a mosh datagram to forward.
+func (r *relayServerClient) accept(from *net.UDPAddr, p []byte) bool {
+	if sameAddr(from, r.remoteAddr) {
+		if string(p) == connectedReply || bytes.HasPrefix(p, []byte(helloCommand)) {
+			return false // late reply to a retransmitted handshake
+		}
+		if r.p2p && bytes.HasPrefix(p, []byte(peerCommand)) {
+			r.setCandidate(p)
+			return false
+		}
+		return true
+	}
+	if !r.p2p {
+		return false
+	}
+	if r.handlePunch(from, p) {
+		return false
+	}
+	return r.fromPeer(from)
+}
+
 func (r *relayServerClient) write(ctx context.Context) error {
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case p := <-r.receiver:
-			if _, err := r.conn.Write(p); err != nil {
+			to := r.route()
+			if _, err := r.conn.WriteToUDP(p, to); err != nil {
 				return fmt.Errorf("failed to write to udp: %w", err)
 			}
+			if r.dedup != nil && to != r.remoteAddr {
+				if _, err := r.conn.WriteToUDP(p, r.remoteAddr); err != nil {
+					return fmt.Errorf("failed to write to udp: %w", err)
+				}
+				to = r.remoteAddr
+			}
+			if to == r.remoteAddr {
+				r.mu.Lock()
+				r.relaySent = time.Now()
+				r.mu.Unlock()
+			}
 		}
 	}
 }
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
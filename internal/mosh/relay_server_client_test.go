@@ -0,0 +1,51 @@
+package mosh
+
+import (
+	"context"
+	"testing"
+)
+
+// TestRelayRoundTrip pairs both halves through a relay on each loopback
+// address and passes datagrams both ways, meant for go test -race.
+func TestRelayRoundTrip(t *testing.T) {
+	for _, tt := range []struct{ network, addr string }{
+		{"udp4", "127.0.0.1:0"},
+		{"udp6", "[::1]:0"},
+	} {
+		t.Run(tt.network, func(t *testing.T) {
+			relay := startTestRelay(t, tt.network, tt.addr)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			client := openTestHalf(ctx, t, relay)
+			server := openTestHalf(ctx, t, relay)
+			for i := 0; i < 20; i++ {
+				client.receiver <- []byte("up")
+				if got := receive(t, server.sender); got != "up" {
+					t.Fatalf("server got %q", got)
+				}
+				server.receiver <- []byte("down")
+				if got := receive(t, client.sender); got != "down" {
+					t.Fatalf("client got %q", got)
+				}
+			}
+		})
+	}
+}
+
+func openTestHalf(ctx context.Context, t *testing.T, relay *testRelay) *relayServerClient {
+	t.Helper()
+	v, err := newRelayVerifier(testLogger(), relay.addr().String(), relay.publicKey(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newRelayServerClient(testLogger(), "key", "mosh-key", relay.addr(), false, make(chan []byte), make(chan []byte))
+	openCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	if err := c.open(openCtx, v, true); err != nil {
+		t.Fatal(err)
+	}
+	go c.serve(ctx)
+	t.Cleanup(func() { c.stop() })
+	return c
+}
@@ -0,0 +1,188 @@
+package mosh
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// relayStreamClient speaks the relay protocol over TCP, optionally wrapped
+// in TLS, for networks that drop UDP. Every datagram, including CONNECT and
+// its acknowledgement, is sent as a frame prefixed with its length as a
+// big-endian uint16. Frames are never larger than maxPacketSize.
+type relayStreamClient struct {
+	log              *logger
+	sender, receiver chan []byte
+	apiKey, moshKey  string
+	addr             string
+	useTLS           bool
+	roots            *x509.CertPool // trusted for TLS, the system's when nil
+
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+func newRelayStreamClient(
+	log *logger, apiKey, moshKey, addr string, useTLS bool, sender, receiver chan []byte,
+) *relayStreamClient {
+	return &relayStreamClient{
+		log:      log,
+		apiKey:   apiKey,
+		moshKey:  moshKey,
+		addr:     addr,
+		useTLS:   useTLS,
+		sender:   sender,
+		receiver: receiver,
+	}
+}
+
+// open dials the relay, verifies its identity, sends CONNECT and waits for
+// the acknowledgement. Without a mosh key the relay is only identified.
+func (r *relayStreamClient) open(ctx context.Context, v *relayVerifier) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return fmt.Errorf("failed to dial tcp: %w", err)
+	}
+	if r.useTLS {
+		host, _, err := net.SplitHostPort(r.addr)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("invalid relay address: %w", err)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, RootCAs: r.roots, MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed tls handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+	r.conn = conn
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	seal, err := v.verify(ctx, r.hello)
+	if err != nil {
+		return err
+	}
+	if r.moshKey == "" {
+		return nil
+	}
+	connect, err := connectCommand(seal, r.apiKey, r.moshKey)
+	if err != nil {
+		return err
+	}
+	if err := r.writeFrame(connect); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	reply, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read connect acknowledgement: %w", err)
+	}
+	if string(reply) != connectedReply {
+		return fmt.Errorf("unexpected connect reply %q", reply)
+	}
+	r.log.Debug("Relay acknowledged connect", "relay", r.addr, "tls", r.useTLS)
+	return nil
+}
+
+func (r *relayStreamClient) hello(ctx context.Context, p []byte) ([]byte, error) {
+	if err := r.writeFrame(p); err != nil {
+		return nil, err
+	}
+	return readFrame(r.conn)
+}
+
+func (r *relayStreamClient) serve(ctx context.Context) error {
+	errs := make(chan error, 2)
+	go func() {
+		if err := r.read(ctx); err != nil {
+			errs <- fmt.Errorf("failed to read: %w", err)
+		}
+	}()
+
+	go func() {
+		if err := r.write(ctx); err != nil {
+			errs <- fmt.Errorf("failed to write: %w", err)
+		}
+	}()
+
+	return await(ctx, errs)
+}
+
+func (r *relayStreamClient) stop() error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
+
+func (r *relayStreamClient) read(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			p, err := readFrame(r.conn)
+			if err != nil {
+				return err
+			}
+			if string(p) == connectedReply {
+				continue
+			}
+			r.sender <- p
+		}
+	}
+}
+
+func (r *relayStreamClient) write(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case p := <-r.receiver:
+			if err := r.writeFrame(p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *relayStreamClient) writeFrame(p []byte) error {
+	if len(p) > maxPacketSize {
+		return fmt.Errorf("datagram of %d bytes exceeds %d", len(p), maxPacketSize)
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	if _, err := r.conn.Write(frame); err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+	return nil
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, fmt.Errorf("failed to read frame size: %w", err)
+	}
+	n := binary.BigEndian.Uint16(size[:])
+	if n > maxPacketSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds %d", n, maxPacketSize)
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, fmt.Errorf("failed to read frame: %w", err)
+	}
+	return p, nil
+}
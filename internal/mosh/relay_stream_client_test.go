@@ -0,0 +1,253 @@
+package mosh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStreamRelay is the TCP side of testRelay: it speaks the same
+// protocol in length-prefixed frames, refusing CONNECTs that are not
+// sealed, and forwards frames between the two connections that connected
+// with the same mosh key.
+type testStreamRelay struct {
+	relay *testRelay // answers HELLO and opens sealed CONNECTs
+	ln    net.Listener
+
+	mu    sync.Mutex // also serializes writes
+	pairs map[string][]net.Conn
+}
+
+// startTestStreamRelay listens on loopback, with TLS when config is set.
+func startTestStreamRelay(t *testing.T, config *tls.Config) *testStreamRelay {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+	r := &testStreamRelay{relay: startTestRelay(t, "udp", "127.0.0.1:0"), ln: ln, pairs: make(map[string][]net.Conn)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *testStreamRelay) serve(conn net.Conn) {
+	for {
+		p, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		switch {
+		case bytes.HasPrefix(p, []byte(helloCommand)):
+			if reply, err := r.relay.hello(p); err == nil {
+				r.write(conn, reply)
+			}
+		case bytes.HasPrefix(p, []byte(sealedCommand)):
+			connect, err := r.relay.open(p)
+			fields := strings.Fields(connect)
+			if err != nil || len(fields) != 3 {
+				return
+			}
+			r.mu.Lock()
+			r.pairs[fields[2]] = append(r.pairs[fields[2]], conn)
+			r.mu.Unlock()
+			r.write(conn, []byte(connectedReply))
+		default:
+			if peer := r.peer(conn); peer != nil {
+				r.write(peer, p)
+			}
+		}
+	}
+}
+
+func (r *testStreamRelay) peer(conn net.Conn) net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, conns := range r.pairs {
+		if len(conns) != 2 {
+			continue
+		}
+		switch conn {
+		case conns[0]:
+			return conns[1]
+		case conns[1]:
+			return conns[0]
+		}
+	}
+	return nil
+}
+
+func (r *testStreamRelay) write(conn net.Conn, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conn.Write(frame(p))
+}
+
+func frame(p []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(p))), p...)
+}
+
+// selfSignedTLS returns a server config for a certificate of 127.0.0.1 and
+// the pool trusting it.
+func selfSignedTLS(t *testing.T) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test relay"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, roots
+}
+
+// TestRelayStreamRoundTrip pairs both halves through a relay over TCP and
+// over TLS and passes datagrams both ways.
+func TestRelayStreamRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		useTLS bool
+	}{{"tcp", false}, {"tls", true}} {
+		useTLS := tt.useTLS
+		t.Run(tt.name, func(t *testing.T) {
+			var config *tls.Config
+			var roots *x509.CertPool
+			if useTLS {
+				config, roots = selfSignedTLS(t)
+			}
+			relay := startTestStreamRelay(t, config)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			open := func() *relayStreamClient {
+				addr := relay.ln.Addr().String()
+				v, err := newRelayVerifier(testLogger(), addr, relay.relay.publicKey(), false, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c := newRelayStreamClient(testLogger(), "key", "mosh-key", addr, useTLS, make(chan []byte), make(chan []byte))
+				c.roots = roots
+				openCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+				defer cancel()
+				if err := c.open(openCtx, v); err != nil {
+					t.Fatal(err)
+				}
+				go c.serve(ctx)
+				t.Cleanup(func() { c.stop() })
+				return c
+			}
+			client, server := open(), open()
+			for i := 0; i < 20; i++ {
+				client.receiver <- []byte("up")
+				if got := receive(t, server.sender); got != "up" {
+					t.Fatalf("server got %q", got)
+				}
+				server.receiver <- []byte("down")
+				if got := receive(t, client.sender); got != "down" {
+					t.Fatalf("client got %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestRelayStreamRejectsUntrustedCertificate(t *testing.T) {
+	config, _ := selfSignedTLS(t)
+	relay := startTestStreamRelay(t, config)
+	addr := relay.ln.Addr().String()
+	v, err := newRelayVerifier(testLogger(), addr, relay.relay.publicKey(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newRelayStreamClient(testLogger(), "key", "mosh-key", addr, true, make(chan []byte), make(chan []byte))
+	defer c.stop()
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	if err := c.open(ctx, v); err == nil || !strings.Contains(err.Error(), "tls") {
+		t.Fatalf("open = %v, want the TLS handshake to fail", err)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	full := bytes.Repeat([]byte("x"), maxPacketSize)
+	for _, tt := range []struct {
+		name string
+		in   []byte
+		want []byte
+		err  string
+	}{
+		{"datagram", frame([]byte("hi")), []byte("hi"), ""},
+		{"empty datagram", frame(nil), []byte{}, ""},
+		{"largest datagram", frame(full), full, ""},
+		{"no input", nil, nil, "frame size"},
+		{"truncated size", []byte{0}, nil, "frame size"},
+		{"truncated datagram", []byte{0, 5, 'a', 'b'}, nil, "failed to read frame"},
+		{"oversized", frame(append(full, 'x')), nil, "exceeds"},
+		{"oversized size only", []byte{0xff, 0xff}, nil, "exceeds"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := readFrame(bytes.NewReader(tt.in))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("readFrame = %q, %v, want error containing %q", p, err, tt.err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(p, tt.want) {
+				t.Fatalf("readFrame = %q, %v, want %q", p, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteFrameOversized(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := &relayStreamClient{conn: client}
+	if err := c.writeFrame(make([]byte, maxPacketSize+1)); err == nil {
+		t.Fatal("wrote a frame larger than maxPacketSize")
+	}
+}
@@ -0,0 +1,209 @@
+package mosh
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRelay is a UDP relay speaking the protocol the clients expect: it
+// answers HELLO, opens sealed CONNECTs and forwards datagrams between the
+// two addresses that connected with the same mosh key.
+type testRelay struct {
+	priv ed25519.PrivateKey
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	shares   map[string]*ecdh.PrivateKey // relay share by client share
+	pairs    map[string][]*net.UDPAddr   // connected addresses by mosh key
+	connects []string                    // CONNECT commands as received
+	noHello  bool                        // drop HELLO, as relays predating it or an attacker on path
+}
+
+func startTestRelay(t *testing.T, network, addr string) *testRelay {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", addr, err)
+	}
+	r := &testRelay{
+		priv:   priv,
+		conn:   conn,
+		shares: make(map[string]*ecdh.PrivateKey),
+		pairs:  make(map[string][]*net.UDPAddr),
+	}
+	t.Cleanup(func() { conn.Close() })
+	go r.serve()
+	return r
+}
+
+func (r *testRelay) addr() *net.UDPAddr {
+	return r.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (r *testRelay) publicKey() string {
+	return encodeRelayKey(r.priv.Public().(ed25519.PublicKey))
+}
+
+func (r *testRelay) serve() {
+	p := make([]byte, maxPacketSize)
+	for {
+		n, from, err := r.conn.ReadFromUDP(p)
+		if err != nil {
+			return
+		}
+		switch msg := p[:n]; {
+		case bytes.HasPrefix(msg, []byte(helloCommand)):
+			r.mu.Lock()
+			drop := r.noHello
+			r.mu.Unlock()
+			if drop {
+				continue
+			}
+			if reply, err := r.hello(msg); err == nil {
+				r.conn.WriteToUDP(reply, from)
+			}
+		case bytes.HasPrefix(msg, []byte(sealedCommand)), bytes.HasPrefix(msg, []byte("CONNECT ")):
+			if err := r.connect(msg, from); err == nil {
+				r.conn.WriteToUDP([]byte(connectedReply), from)
+			}
+		default:
+			if peer := r.peer(from); peer != nil {
+				r.conn.WriteToUDP(msg, peer)
+			}
+		}
+	}
+}
+
+// hello answers "HELLO <nonce> <client share>".
+func (r *testRelay) hello(p []byte) ([]byte, error) {
+	fields := strings.Fields(strings.TrimPrefix(string(p), helloCommand))
+	if len(fields) != 2 {
+		return nil, errors.New("malformed hello")
+	}
+	nonce, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	clientShare, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.shares[fields[1]] = priv
+	r.mu.Unlock()
+	relayShare := priv.PublicKey().Bytes()
+	sig := ed25519.Sign(r.priv, helloSigned(nonce, clientShare, relayShare))
+	return []byte(helloCommand + r.publicKey() + " " + base64.StdEncoding.EncodeToString(sig) + " " +
+		base64.StdEncoding.EncodeToString(relayShare)), nil
+}
+
+// open returns the CONNECT command p carries, unsealing it if needed.
+func (r *testRelay) open(p []byte) (string, error) {
+	rest, ok := bytes.CutPrefix(p, []byte(sealedCommand))
+	if !ok {
+		return string(p), nil
+	}
+	encodedShare, encodedSealed, ok := strings.Cut(string(rest), " ")
+	if !ok {
+		return "", errors.New("malformed sealed connect")
+	}
+	r.mu.Lock()
+	priv := r.shares[encodedShare]
+	r.mu.Unlock()
+	if priv == nil {
+		return "", errors.New("unknown share")
+	}
+	clientShare, err := base64.StdEncoding.DecodeString(encodedShare)
+	if err != nil {
+		return "", err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(clientShare)
+	if err != nil {
+		return "", err
+	}
+	secret, err := priv.ECDH(peer)
+	if err != nil {
+		return "", err
+	}
+	aead, err := sealKey(secret, clientShare, priv.PublicKey().Bytes())
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encodedSealed)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed sealed connect")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	return string(plain), err
+}
+
+func (r *testRelay) connect(p []byte, from *net.UDPAddr) error {
+	connect, err := r.open(p)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(connect)
+	if len(fields) != 3 || fields[0] != "CONNECT" {
+		return errors.New("malformed connect")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connects = append(r.connects, string(p))
+	for _, addr := range r.pairs[fields[2]] {
+		if sameAddr(addr, from) {
+			return nil
+		}
+	}
+	r.pairs[fields[2]] = append(r.pairs[fields[2]], from)
+	return nil
+}
+
+func (r *testRelay) peer(from *net.UDPAddr) *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, addrs := range r.pairs {
+		if len(addrs) != 2 {
+			continue
+		}
+		switch {
+		case sameAddr(addrs[0], from):
+			return addrs[1]
+		case sameAddr(addrs[1], from):
+			return addrs[0]
+		}
+	}
+	return nil
+}
+
+func (r *testRelay) dropHello() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.noHello = true
+}
+
+func (r *testRelay) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.connects...)
+}
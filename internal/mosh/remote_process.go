@@ -0,0 +1,131 @@
+package mosh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// remoteProcess runs the server half on the remote host and reads its
+// control stream.
+type remoteProcess struct {
+	log        *logger
+	launcher   remoteLauncher
+	stdin      []string // secrets for the server half, one per line
+	remoteAddr string
+	command    []string
+	args       []string // gh-mosh flags for the server half
+
+	cmd    *exec.Cmd
+	reader *io.PipeReader
+	writer *io.PipeWriter // receives the server half's control stream
+}
+
+func newRemoteProcess(
+	log *logger, launcher remoteLauncher, stdin []string, remoteAddr string, command, args []string,
+) *remoteProcess {
+	reader, writer := io.Pipe()
+	return &remoteProcess{
+		log:        log,
+		launcher:   launcher,
+		stdin:      stdin,
+		remoteAddr: remoteAddr,
+		command:    command,
+		args:       args,
+		reader:     reader,
+		writer:     writer,
+	}
+}
+
+func (r *remoteProcess) start(ctx context.Context) error {
+	r.cmd = r.processCmd(ctx)
+	r.cmd.Stdin = strings.NewReader(strings.Join(r.stdin, "\n") + "\n")
+	r.cmd.Stdout = r.writer
+	r.cmd.Stderr = r.log.forwardWriter()
+	if err := r.cmd.Start(); err != nil {
+		r.writer.CloseWithError(err)
+		return err
+	}
+	err := r.cmd.Wait()
+	r.writer.CloseWithError(err) // a nil error closes the stream with io.EOF
+	return err
+}
+
+// processCmd returns the command running the server half.
+func (r *remoteProcess) processCmd(ctx context.Context) *exec.Cmd {
+	// The API key, and the mosh key when attaching, are written to stdin,
+	// environment variables are visible to every process the server half
+	// starts.
+	env := []string{"REMOTE_ADDR=" + r.remoteAddr, "SERVER=true"}
+	args := append([]string{"--api-key-stdin"}, r.args...)
+	if len(r.command) > 0 {
+		args = append(args, "--")
+		args = append(args, r.command...)
+	}
+	return r.launcher.command(ctx, env, args)
+}
+
+func (r *remoteProcess) stop() error {
+	if r.cmd == nil || r.cmd.Process == nil {
+		return nil
+	}
+	if err := r.cmd.Process.Signal(os.Kill); err != nil && err != os.ErrProcessDone {
+		return err
+	}
+	return nil
+}
+
+// connect waits for the server half to report that mosh-server is ready and
+// returns the connect message. Control messages that follow it keep being
+// read and logged until the server half exits.
+func (r *remoteProcess) connect(ctx context.Context) (controlMessage, error) {
+	connected, errs := make(chan controlMessage, 1), make(chan error, 1)
+	go func() {
+		ctl := newControlReader(r.reader)
+		var sent bool
+		for {
+			msg, err := ctl.next()
+			if err != nil {
+				switch {
+				case !sent && err == io.EOF:
+					errs <- errors.New("server exited before sending connection details")
+				case !sent:
+					errs <- err
+				case err != io.EOF:
+					r.log.Error("Server error", "err", err)
+				}
+				return
+			}
+			switch msg.Type {
+			case controlProgress:
+				r.log.Info(msg.Message)
+			case controlConnect:
+				if !sent {
+					sent = true
+					connected <- msg
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return controlMessage{}, ctx.Err()
+	case err := <-errs:
+		return controlMessage{}, err
+	case msg := <-connected:
+		return msg, nil
+	}
+}
+
+// shellJoin quotes args so a remote shell splits them back into args.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
@@ -4,17 +4,22 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 type moshServerClient struct {
+	log              *logger
 	sender, receiver chan []byte
 	port             int64
 
-	conn *net.UDPConn
+	conn       *net.UDPConn
+	lastActive atomic.Int64 // unix nanoseconds of the last datagram from the client
 }
 
-func newMoshServerClient(port int64, sender, receiver chan []byte) *moshServerClient {
+func newMoshServerClient(log *logger, port int64, sender, receiver chan []byte) *moshServerClient {
 	return &moshServerClient{
+		log:      log,
 		sender:   sender,
 		receiver: receiver,
 		port:     port,
@@ -22,15 +27,13 @@ func newMoshServerClient(port int64, sender, receiver chan []byte) *moshServerCl
 }
 
 func (m *moshServerClient) connect(ctx context.Context) error {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", m.port))
-	if err != nil {
-		return err
-	}
+	addr := &net.UDPAddr{IP: loopbackIP(), Port: int(m.port)}
 	conn, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
 		return fmt.Errorf("failed to dial udp: %w", err)
 	}
 	m.conn = conn
+	m.log.Debug("Connected to mosh server", "addr", addr)
 
 	errs := make(chan error, 2)
 	go func() {
@@ -48,6 +51,16 @@ func (m *moshServerClient) connect(ctx context.Context) error {
 	return nil
 }
 
+// lastActivity returns when the client last sent a datagram, the zero time
+// if it never did.
+func (m *moshServerClient) lastActivity() time.Time {
+	ns := m.lastActive.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
 func (m *moshServerClient) stop() error {
 	return m.conn.Close()
 }
@@ -74,6 +87,7 @@ func (m *moshServerClient) write(ctx context.Context) error {
 		case <-ctx.Done():
 			return ctx.Err()
 		case p := <-m.receiver:
+			m.lastActive.Store(time.Now().UnixNano())
 			if _, err := m.conn.Write(p); err != nil {
 				return fmt.Errorf("failed to write to udp: %w", err)
 			}
@@ -1,6 +1,7 @@
 package mosh
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -15,17 +16,26 @@ import (
 const mostServerBinary = "mosh-server"
 
 type serverProcess struct {
+	command []string // run by mosh-server instead of the login shell when set
+
 	output []byte
+	stderr bytes.Buffer
 	cmd    *exec.Cmd
 }
 
-func newServerProcess() *serverProcess {
-	return &serverProcess{}
+func newServerProcess(command []string) *serverProcess {
+	return &serverProcess{command: command}
 }
 
 func (s *serverProcess) run(ctx context.Context) error {
 	s.cmd = s.processCmd(ctx)
-	s.cmd.Env = os.Environ()
+	s.cmd.Args = append(s.cmd.Args, "new")
+	if len(s.command) > 0 {
+		s.cmd.Args = append(s.cmd.Args, "--")
+		s.cmd.Args = append(s.cmd.Args, s.command...)
+	}
+	s.cmd.Env = childEnv()
+	s.cmd.Stderr = &s.stderr
 	output, err := s.cmd.Output()
 	if err != nil {
 		return err
@@ -57,6 +67,21 @@ func (s *serverProcess) connDetails() (port int64, moshKey string, err error) {
 	return 0, "", errors.New("no mosh key found")
 }
 
+// pid returns the process ID of the detached mosh-server, reported on
+// stderr as "[mosh-server detached, pid = 1234]", or 0 if it is unknown.
+func (s *serverProcess) pid() int {
+	_, after, ok := strings.Cut(s.stderr.String(), "pid = ")
+	if !ok {
+		return 0
+	}
+	end := strings.IndexFunc(after, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(after)
+	}
+	pid, _ := strconv.Atoi(after[:end])
+	return pid
+}
+
 func (s *serverProcess) installed() bool {
 	_, err := exec.LookPath(mostServerBinary)
 	return err == nil
@@ -89,9 +114,10 @@ func (s *serverProcess) stop() error {
 	if s.cmd == nil {
 		return nil
 	}
-	if err := s.cmd.Process.Signal(os.Kill); err != nil && err != os.ErrProcessDone {
+	// This only stops "mosh-server new" should it still be running, the
+	// mosh-server it detached runs in its own session and outlives us.
+	if err := s.cmd.Process.Signal(os.Kill); err != nil && !errors.Is(err, os.ErrProcessDone) {
 		return err
 	}
-	// TODO(josebalius): does this kill a detached process?
-	return s.cmd.Process.Signal(os.Kill)
+	return nil
 }
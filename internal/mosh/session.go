@@ -0,0 +1,336 @@
+package mosh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/josebalius/gh-mosh/internal/session"
+)
+
+// newSession describes the session the server half reported, so it can be
+// resumed should this process die while mosh-client and mosh-server run.
+func (a *App) newSession(details controlMessage, relayKeys map[string]string) *session.Session {
+	return &session.Session{
+		ID:         a.opts.SessionID,
+		Codespace:  a.opts.Codespace,
+		SSH:        a.opts.SSH,
+		Relays:     a.relays,
+		RelayKeys:  relayKeys,
+		MoshKey:    details.MoshKey,
+		ServerPort: details.ServerPort,
+		Command:    a.opts.Command,
+		Started:    time.Now(),
+	}
+}
+
+// saveSession records sess until forgetSession is called. Failing to record
+// it only costs the ability to resume, so errors are logged.
+func (a *App) saveSession(sess *session.Session) {
+	if sess.ServerPort == 0 {
+		return
+	}
+	store, err := session.NewStore()
+	if err == nil {
+		err = store.Save(sess)
+	}
+	if err != nil {
+		a.log.Warn("Session will not be resumable", "err", err)
+		return
+	}
+	a.log.Info("Session recorded, gh mosh resume reconnects mosh-client should gh-mosh exit", "session", sess.ID)
+}
+
+// resumable reports why sess cannot be resumed. Only the relay leg can be
+// reconnected: mosh-client and mosh-server keep the session's state, so
+// mosh-client must still be running. A new mosh-client would start from
+// scratch, which mosh-server does not accept.
+func resumable(sess *session.Session) error {
+	if sess.MoshClientPID == 0 || sess.ListenAddr == "" {
+		return fmt.Errorf("session %s has no mosh-client to reconnect", sess.ID)
+	}
+	if Attached(sess) {
+		return fmt.Errorf("session %s is still attached", sess.ID)
+	}
+	if !ownsUDPPort(sess.MoshClientPID, 0) {
+		return fmt.Errorf("mosh-client of session %s exited and mosh cannot attach a new one, end the session with gh mosh kill %s", sess.ID, sess.ID)
+	}
+	return nil
+}
+
+// Attached reports whether another gh-mosh still relays for sess, holding
+// the port its mosh-client sends to.
+func Attached(sess *session.Session) bool {
+	_, port, err := net.SplitHostPort(sess.ListenAddr)
+	if err != nil {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p == 0 {
+		return false
+	}
+	return sess.ClientPID != os.Getpid() && ownsUDPPort(sess.ClientPID, p)
+}
+
+// forgetSession removes the record of a session that ended.
+func (a *App) forgetSession(sess *session.Session) {
+	if sess == nil {
+		return
+	}
+	store, err := session.NewStore()
+	if err == nil {
+		err = store.Remove(sess.ID)
+	}
+	if err != nil {
+		a.log.Warn("Failed to forget session", "session", sess.ID, "err", err)
+	}
+}
+
+// serverRunning reports whether mosh-server, process pid, still holds
+// port. Without its PID mosh-server cannot be told apart from whatever
+// else may take the port, so it is reported as not running.
+func serverRunning(pid, port int) bool {
+	return ownsUDPPort(pid, port)
+}
+
+// waitExit returns once process pid no longer holds port, any UDP port
+// when it is 0, or ctx is done.
+func waitExit(ctx context.Context, pid, port int) {
+	ticker := time.NewTicker(exitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !ownsUDPPort(pid, port) {
+				return
+			}
+		}
+	}
+}
+
+// exitInterval is how often processes outliving gh-mosh are checked for.
+const exitInterval = time.Second
+
+// activityInterval is how often the server half updates its record with the
+// client's last activity.
+const activityInterval = 10 * time.Second
+
+// recordServerSession keeps the server half's record of the session up to
+// date until ctx is done. The record outlives this process, as mosh-server
+// does, so the session can still be listed and killed.
+func (a *App) recordServerSession(ctx context.Context, port, serverPID int, client *moshServerClient) {
+	store, err := session.NewServerStore()
+	if err != nil {
+		a.log.Warn("Failed to record session", "err", err)
+		return
+	}
+	sess, err := store.Find(a.opts.SessionID)
+	if err != nil || sess.ID != a.opts.SessionID {
+		sess = &session.Session{ID: a.opts.SessionID, ServerPort: port, ServerPID: serverPID, Started: time.Now()}
+	}
+	// Killing the agent would end every session it runs, mosh-server
+	// exiting is enough to end this one.
+	sess.ServerHalfPID = 0
+	if !a.inAgent {
+		sess.ServerHalfPID = os.Getpid()
+	}
+
+	ticker := time.NewTicker(activityInterval)
+	defer ticker.Stop()
+	for {
+		if t := client.lastActivity(); t.After(sess.LastActivity) {
+			sess.LastActivity = t
+		}
+		if err := store.Save(sess); err != nil {
+			a.log.Warn("Failed to record session", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resumedServer returns the PID of the session's mosh-server, as recorded
+// by the server half that started it, once sure it still holds port.
+func (a *App) resumedServer(port int) (int, error) {
+	if a.opts.SessionID == "" {
+		return 0, errors.New("attaching to mosh-server requires --session")
+	}
+	store, err := session.NewServerStore()
+	if err != nil {
+		return 0, err
+	}
+	sess, err := store.Find(a.opts.SessionID)
+	if errors.Is(err, session.ErrNotFound) || (err == nil && (sess.ID != a.opts.SessionID || sess.ServerPort != port)) {
+		return 0, fmt.Errorf("no record of session %s on port %d", a.opts.SessionID, port)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !serverRunning(sess.ServerPID, port) {
+		return 0, fmt.Errorf("mosh-server of session %s is no longer running", sess.ID)
+	}
+	return sess.ServerPID, nil
+}
+
+// ServerSession is the server half's record of a session on its host.
+type ServerSession struct {
+	session.Session
+	Running bool `json:"running"` // mosh-server still runs and holds its port
+}
+
+// ServerSessions lists the sessions recorded by server halves on this host.
+func ServerSessions() ([]ServerSession, error) {
+	store, err := session.NewServerStore()
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]ServerSession, len(sessions))
+	for i, sess := range sessions {
+		statuses[i] = ServerSession{Session: *sess, Running: serverRunning(sess.ServerPID, sess.ServerPort)}
+	}
+	return statuses, nil
+}
+
+// PruneServerSessions removes the records of sessions on this host whose
+// mosh-server exited.
+func PruneServerSessions() error {
+	store, err := session.NewServerStore()
+	if err != nil {
+		return err
+	}
+	sessions, err := ServerSessions()
+	if err != nil {
+		return err
+	}
+	for _, sess := range sessions {
+		if sess.Running {
+			continue
+		}
+		if err := store.Remove(sess.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KillServerSession terminates mosh-server and the server half of the
+// session id on this host.
+func KillServerSession(id string) error {
+	store, err := session.NewServerStore()
+	if err != nil {
+		return err
+	}
+	sess, err := store.Find(id)
+	if errors.Is(err, session.ErrNotFound) {
+		return nil // mosh-server exited and its record was pruned
+	}
+	if err != nil {
+		return err
+	}
+	// Only signal mosh-server while it holds its port, its PID may have
+	// been reused otherwise.
+	if serverRunning(sess.ServerPID, sess.ServerPort) {
+		if err := terminate(sess.ServerPID); err != nil {
+			return fmt.Errorf("failed to stop mosh-server: %w", err)
+		}
+	}
+	if sess.ServerHalfPID != os.Getpid() && ownsUDPPort(sess.ServerHalfPID, 0) {
+		terminate(sess.ServerHalfPID)
+	}
+	return store.Remove(sess.ID)
+}
+
+// RemoteSessions lists the server half's sessions on remote, see
+// ServerSessions.
+func RemoteSessions(ctx context.Context, remote Remote) ([]ServerSession, error) {
+	if remote.local() {
+		return ServerSessions()
+	}
+	out, err := remote.launcher().command(ctx, nil, []string{"sessions", "--remote"}).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions in %s: %w", remote, err)
+	}
+	var sessions []ServerSession
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var sess ServerSession
+		err := dec.Decode(&sess)
+		if err == io.EOF {
+			return sessions, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sessions in %s: %w", remote, err)
+		}
+		sessions = append(sessions, sess)
+	}
+}
+
+// PruneRemoteSessions removes the records of ended sessions on remote, see
+// PruneServerSessions.
+func PruneRemoteSessions(ctx context.Context, remote Remote) error {
+	if remote.local() {
+		return PruneServerSessions()
+	}
+	if out, err := remote.launcher().command(ctx, nil, []string{"sessions", "--remote", "--prune"}).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to prune sessions in %s: %w: %s", remote, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// KillRemoteSession terminates the server side of session id on remote,
+// see KillServerSession.
+func KillRemoteSession(ctx context.Context, remote Remote, id string) error {
+	if remote.local() {
+		return KillServerSession(id)
+	}
+	if out, err := remote.launcher().command(ctx, nil, []string{"kill", "--remote", id}).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to kill session in %s: %w: %s", remote, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// KillSession terminates sess, on the server side then the local gh-mosh
+// and mosh-client attached to it, and forgets it.
+func KillSession(ctx context.Context, sess *session.Session) error {
+	if err := KillRemoteSession(ctx, SessionRemote(sess), sess.ID); err != nil {
+		return err
+	}
+	// Signal only processes still holding the session's sockets, their
+	// PIDs may have been reused otherwise.
+	if Attached(sess) {
+		if err := terminate(sess.ClientPID); err != nil {
+			return fmt.Errorf("failed to stop gh-mosh: %w", err)
+		}
+	}
+	if ownsUDPPort(sess.MoshClientPID, 0) {
+		if err := terminate(sess.MoshClientPID); err != nil {
+			return fmt.Errorf("failed to stop mosh-client: %w", err)
+		}
+	}
+	store, err := session.NewStore()
+	if err != nil {
+		return err
+	}
+	return store.Remove(sess.ID)
+}
+
+// SessionRemote returns the remote sess runs on.
+func SessionRemote(sess *session.Session) Remote {
+	return Remote{Codespace: sess.Codespace, SSH: sess.SSH}
+}
@@ -0,0 +1,54 @@
+package mosh
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/josebalius/gh-mosh/internal/session"
+)
+
+func TestServerSessionsArePrunedExplicitly(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	store, err := session.NewServerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := listenLoopback(t) // stands in for mosh-server
+	running := &session.Session{
+		ID: "running", ServerPID: os.Getpid(), ServerPort: conn.LocalAddr().(*net.UDPAddr).Port, Started: time.Now(),
+	}
+	ended := &session.Session{ID: "ended", ServerPID: os.Getpid(), ServerPort: 1, Started: time.Now()}
+	for _, sess := range []*session.Session{running, ended} {
+		if err := store.Save(sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listed, err := ServerSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, sess := range listed {
+		got[sess.ID] = sess.Running
+	}
+	if len(got) != 2 || !got["running"] || got["ended"] {
+		t.Fatalf("ServerSessions = %v, want running and ended", got)
+	}
+	if sessions, _ := store.List(); len(sessions) != 2 {
+		t.Fatalf("listing removed records, %d left", len(sessions))
+	}
+
+	if err := PruneServerSessions(); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "running" {
+		t.Fatalf("pruning left %d records", len(sessions))
+	}
+}
@@ -0,0 +1,263 @@
+package mosh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/josebalius/gh-mosh/internal/config"
+)
+
+// Relay transports.
+const (
+	TransportAuto = "auto" // UDP, then TLS, then UDP without acknowledgement, starting with what last worked
+	TransportUDP  = "udp"
+	TransportTCP  = "tcp"
+	TransportTLS  = "tls"  // TCP wrapped in TLS, port 443 by default
+	TransportQUIC = "quic" // QUIC datagrams, port 443 by default
+)
+
+// connectedReply acknowledges CONNECT. Relays predating it never send it,
+// which is why only the automatic transport waits for it over UDP.
+const connectedReply = "CONNECTED"
+
+const (
+	handshakeTimeout = 3 * time.Second
+	handshakeRetry   = 500 * time.Millisecond
+)
+
+// relayClient pairs with the other half through a relay and forwards mosh
+// datagrams between it and the local channels.
+type relayClient interface {
+	serve(ctx context.Context) error
+	stop() error
+}
+
+// openRelay connects to relay with the configured transport once it has
+// proved its identity, see relayVerifier. The automatic transport uses UDP
+// when the relay acknowledges CONNECT in time and TLS otherwise. If neither
+// works it falls back to UDP without waiting for an acknowledgement, as
+// older relays never send one. Relays that do not answer HELLO are only
+// used when listed in Options.LegacyRelays. Whichever of these last worked
+// for relay is tried first. With an empty moshKey the relay is only
+// identified and CONNECT is never sent.
+func (a *App) openRelay(ctx context.Context, relay, moshKey string, sender, receiver chan []byte) (relayClient, error) {
+	log := a.log.with("relay")
+	transport := a.opts.Transport
+	if transport == "" {
+		transport = TransportAuto
+	}
+	verifier, err := a.relayVerifier(log, relay)
+	if err != nil {
+		return nil, err
+	}
+	verifier.ping = moshKey == ""
+	verifier.allowLegacy = slices.Contains(a.opts.LegacyRelays, relay)
+
+	openUDP := func(waitAck bool) (relayClient, error) {
+		return dialHappyEyeballs(ctx, relay, func(ctx context.Context, remoteAddr *net.UDPAddr) (relayClient, error) {
+			c := newRelayServerClient(log, a.apiKey, moshKey, remoteAddr, a.opts.PeerToPeer, sender, receiver)
+			if a.opts.Multipath && a.opts.PeerToPeer {
+				c.dedup = newDedupWindow()
+			}
+			ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+			defer cancel()
+			if err := c.open(ctx, verifier, waitAck); err != nil {
+				c.stop()
+				return nil, err
+			}
+			return c, nil
+		})
+	}
+	openStream := func(useTLS bool) (relayClient, error) {
+		addr, err := a.streamAddr(relay, useTLS)
+		if err != nil {
+			return nil, err
+		}
+		c := newRelayStreamClient(log, a.apiKey, moshKey, addr, useTLS, sender, receiver)
+		ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+		defer cancel()
+		if err := c.open(ctx, verifier); err != nil {
+			c.stop()
+			return nil, err
+		}
+		return c, nil
+	}
+
+	openQUIC := func() (relayClient, error) {
+		addr, err := a.quicAddr(relay)
+		if err != nil {
+			return nil, err
+		}
+		return dialHappyEyeballs(ctx, addr, func(ctx context.Context, remoteAddr *net.UDPAddr) (relayClient, error) {
+			c := newRelayQUICClient(log, a.apiKey, moshKey, addr, remoteAddr, sender, receiver)
+			ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+			defer cancel()
+			if err := c.open(ctx, verifier); err != nil {
+				c.stop()
+				return nil, err
+			}
+			return c, nil
+		})
+	}
+
+	switch transport {
+	case TransportQUIC:
+		return openQUIC()
+	case TransportUDP:
+		return openUDP(false)
+	case TransportTCP:
+		return openStream(false)
+	case TransportTLS:
+		return openStream(true)
+	case TransportAuto:
+	default:
+		return nil, fmt.Errorf("unknown transport %q", transport)
+	}
+
+	steps := []struct {
+		name string
+		open func() (relayClient, error)
+	}{
+		{autoUDP, func() (relayClient, error) { return openUDP(true) }},
+		{autoTLS, func() (relayClient, error) { return openStream(true) }},
+		{autoUDPNoAck, func() (relayClient, error) { return openUDP(false) }},
+	}
+	// Start with what worked last time, so a relay that needs TLS does not
+	// cost every session the UDP handshake timeout first.
+	memory := newTransportMemory()
+	last := memory.last(log, relay)
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].name == last && steps[j].name != last })
+
+	var errs []error
+	for _, step := range steps {
+		c, err := step.open()
+		if err == nil {
+			if step.name != last {
+				memory.remember(log, relay, step.name)
+			}
+			return c, nil
+		}
+		log.Info("Handshake failed, trying the next transport", "relay", relay, "transport", step.name, "err", err)
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Steps of the automatic transport, as recorded by transportMemory.
+const (
+	autoUDP      = "udp"
+	autoTLS      = "tls"
+	autoUDPNoAck = "udp-noack"
+)
+
+// transportMemory records which step of the automatic transport last
+// connected to each relay. It is only a hint, so failing to read or write
+// it is logged and otherwise ignored.
+type transportMemory struct {
+	path string
+}
+
+func newTransportMemory() *transportMemory {
+	dir, err := config.StateDir()
+	if err != nil {
+		return &transportMemory{}
+	}
+	return &transportMemory{path: filepath.Join(dir, "relay_transports.json")}
+}
+
+// last returns the step that last connected to relay, "" if none did.
+func (m *transportMemory) last(log *logger, relay string) string {
+	transports, err := m.load()
+	if err != nil {
+		log.Debug("Failed to read relay transports", "err", err)
+	}
+	return transports[relay]
+}
+
+func (m *transportMemory) remember(log *logger, relay, step string) {
+	if err := m.save(relay, step); err != nil {
+		log.Debug("Failed to record relay transport", "relay", relay, "err", err)
+	}
+}
+
+func (m *transportMemory) save(relay, step string) error {
+	if m.path == "" {
+		return errors.New("no state directory")
+	}
+	// An unreadable file is replaced, it only held hints.
+	transports, _ := m.load()
+	transports[relay] = step
+	b, err := json.MarshalIndent(transports, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode relay transports: %w", err)
+	}
+	return config.WriteFile(m.path, b, 0600)
+}
+
+func (m *transportMemory) load() (map[string]string, error) {
+	transports := make(map[string]string)
+	if m.path == "" {
+		return transports, errors.New("no state directory")
+	}
+	b, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return transports, nil
+	}
+	if err != nil {
+		return transports, fmt.Errorf("failed to read relay transports: %w", err)
+	}
+	if err := json.Unmarshal(b, &transports); err != nil {
+		return make(map[string]string), fmt.Errorf("failed to parse relay transports: %w", err)
+	}
+	return transports, nil
+}
+
+// relayVerifier returns the verifier for relay's identity. Only the client
+// records keys trusted on first use, the server half is given the key the
+// client verified for each relay and refuses relays without one.
+func (a *App) relayVerifier(log *logger, relay string) (*relayVerifier, error) {
+	pinned := a.opts.RelayPublicKey
+	if pinned == "" {
+		pinned = a.opts.RelayKeys[relay]
+	}
+	if a.appType == AppTypeServer && pinned == "" && !a.opts.InsecureRelay {
+		return nil, fmt.Errorf("relay %s was not verified by the client", relay)
+	}
+	return newRelayVerifier(log, relay, pinned, a.appType == AppTypeClient, a.opts.InsecureRelay)
+}
+
+// streamAddr returns relay's TCP address, defaulting to the UDP relay's port
+// for plain TCP and to 443 for TLS.
+func (a *App) streamAddr(relay string, useTLS bool) (string, error) {
+	if a.opts.RelayStreamAddr != "" {
+		return a.opts.RelayStreamAddr, nil
+	}
+	if !useTLS {
+		return relay, nil
+	}
+	host, _, err := net.SplitHostPort(relay)
+	if err != nil {
+		return "", fmt.Errorf("invalid relay address: %w", err)
+	}
+	return net.JoinHostPort(host, "443"), nil
+}
+
+// quicAddr returns relay's QUIC address, defaulting to port 443.
+func (a *App) quicAddr(relay string) (string, error) {
+	if a.opts.RelayQUICAddr != "" {
+		return a.opts.RelayQUICAddr, nil
+	}
+	host, _, err := net.SplitHostPort(relay)
+	if err != nil {
+		return "", fmt.Errorf("invalid relay address: %w", err)
+	}
+	return net.JoinHostPort(host, "443"), nil
+}
@@ -0,0 +1,69 @@
+package mosh
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTransportMemory(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	log := testLogger()
+	m := newTransportMemory()
+
+	if got := m.last(log, "relay.example.com:9000"); got != "" {
+		t.Fatalf("last = %q before anything was recorded", got)
+	}
+	m.remember(log, "relay.example.com:9000", autoTLS)
+	m.remember(log, "other.example.com:9000", autoUDP)
+	if got := newTransportMemory().last(log, "relay.example.com:9000"); got != autoTLS {
+		t.Fatalf("last = %q, want %q", got, autoTLS)
+	}
+
+	// A damaged file is only a lost hint, and is replaced.
+	if err := os.WriteFile(m.path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.last(log, "relay.example.com:9000"); got != "" {
+		t.Fatalf("last = %q from a damaged file", got)
+	}
+	m.remember(log, "relay.example.com:9000", autoUDPNoAck)
+	if got := m.last(log, "relay.example.com:9000"); got != autoUDPNoAck {
+		t.Fatalf("last = %q, want %q", got, autoUDPNoAck)
+	}
+}
+
+func TestAutoTransportRequiresHello(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	relay := startTestRelay(t, "udp", "127.0.0.1:0")
+	relay.dropHello()
+	addr := relay.addr().String()
+	a := NewApp("key", addr, AppTypeClient, Options{LogOutput: io.Discard})
+
+	if c, err := a.openRelay(context.Background(), addr, "mosh-key", make(chan []byte), make(chan []byte)); err == nil {
+		c.stop()
+		t.Fatal("connected to a relay that did not answer HELLO")
+	}
+	if got := relay.received(); len(got) != 0 {
+		t.Fatalf("sent %q to a relay that did not prove its identity", got)
+	}
+
+	// Listed as predating HELLO, the relay is used unverified.
+	a.opts.LegacyRelays = []string{addr}
+	a.opts.Transport = TransportUDP
+	c, err := a.openRelay(context.Background(), addr, "mosh-key", make(chan []byte), make(chan []byte))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.stop()
+	deadline := time.Now().Add(time.Second)
+	for len(relay.received()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := relay.received(); len(got) != 1 || got[0] != "CONNECT key mosh-key" {
+		t.Fatalf("relay received %q", got)
+	}
+}
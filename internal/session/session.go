@@ -0,0 +1,163 @@
+// Package session records mosh sessions while they run, so the relay can
+// be reconnected between a mosh-client and mosh-server that outlived the
+// gh-mosh processes which started them.
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/josebalius/gh-mosh/internal/config"
+)
+
+// ErrNotFound is returned when no session matches.
+var ErrNotFound = errors.New("session not found")
+
+// Session is what a new gh-mosh needs to reconnect a session's mosh-client to
+// its mosh-server.
+type Session struct {
+	ID        string `json:"id"`
+	Codespace string `json:"codespace,omitempty"`
+	SSH       string `json:"ssh,omitempty"` // destination of a session on an SSH host
+
+	// Relays are in the order both halves try them, with the keys the
+	// client verified for them.
+	Relays    []string          `json:"relays,omitempty"`
+	RelayKeys map[string]string `json:"relay_keys,omitempty"`
+
+	MoshKey    string    `json:"mosh_key,omitempty"`
+	ServerPort int       `json:"server_port"`
+	Command    []string  `json:"command,omitempty"`
+	Started    time.Time `json:"started"`
+
+	// ClientPID is the local gh-mosh process attached to the session.
+	ClientPID int `json:"client_pid,omitempty"`
+
+	// MoshClientPID is the session's mosh-client and ListenAddr the
+	// address it sends to. A new gh-mosh listening there can carry on
+	// while mosh-client runs, mosh cannot attach a new client.
+	MoshClientPID int    `json:"mosh_client_pid,omitempty"`
+	ListenAddr    string `json:"listen_addr,omitempty"`
+
+	// Set in the server half's records only.
+	ServerPID     int       `json:"server_pid,omitempty"`      // mosh-server
+	ServerHalfPID int       `json:"server_half_pid,omitempty"` // gh-mosh relaying for it
+	LastActivity  time.Time `json:"last_activity,omitempty"`   // last datagram from the client
+}
+
+// Store keeps one file per session, readable only by the user as it holds
+// the session's mosh key.
+type Store struct {
+	dir string
+}
+
+// NewStore returns the client's store.
+func NewStore() (*Store, error) {
+	return newStore("sessions")
+}
+
+// NewServerStore returns the server half's store. It is kept apart from
+// the client's so both halves can run on one host during development.
+func NewServerStore() (*Store, error) {
+	return newStore("server-sessions")
+}
+
+func newStore(name string) (*Store, error) {
+	dir, err := config.StateDir()
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: filepath.Join(dir, name)}, nil
+}
+
+// NewID returns a random session ID.
+func NewID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// Save records the session, replacing an earlier record with its ID.
+func (s *Store) Save(sess *Session) error {
+	b, err := json.MarshalIndent(sess, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+	return config.WriteFile(s.path(sess.ID), b, 0600)
+}
+
+// List returns the recorded sessions, most recently started first.
+func (s *Store) List() ([]*Session, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	var sessions []*Session
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read session: %w", err)
+		}
+		var sess Session
+		if err := json.Unmarshal(b, &sess); err != nil {
+			return nil, fmt.Errorf("failed to parse session %s: %w", e.Name(), err)
+		}
+		sessions = append(sessions, &sess)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.After(sessions[j].Started) })
+	return sessions, nil
+}
+
+// Find returns the session whose ID starts with prefix, or the most recent
+// session if prefix is empty.
+func (s *Store) Find(prefix string) (*Session, error) {
+	sessions, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var found *Session
+	for _, sess := range sessions {
+		if !strings.HasPrefix(sess.ID, prefix) {
+			continue
+		}
+		if prefix == "" {
+			return sess, nil
+		}
+		if found != nil {
+			return nil, fmt.Errorf("session %q is ambiguous", prefix)
+		}
+		found = sess
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// Remove deletes the session's record.
+func (s *Store) Remove(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove session: %w", err)
+	}
+	return nil
+}